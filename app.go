@@ -4,16 +4,20 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"os"
 )
 
 func StartServer(serverPort int) {
 	db, _ := MakeDB()
-	nodeID := strings.Replace(PseudoUUID(), "-", "", -1)
+	keypair, err := LoadNodeKeypair(NODE_KEY_FILE, os.Getenv(NODE_PASSPHRASE_ENV))
+	if err != nil {
+		log.Fatalf("Failed to load the node key: %s", err)
+	}
+	SetNodeKeypair(keypair)
 
 	go func() {
 		log.Printf("Starting QB Chain HTTP API Server. Listening at port %d", serverPort)
-		http.Handle("/", NewHandler(nodeID, db))
+		http.Handle("/", NewHandler(keypair, db, NewSyncer(db), NewPeerRegistry(db), nil, nil, nil))
 		http.ListenAndServe(fmt.Sprintf(":%d", serverPort), nil)
 	}()
 }
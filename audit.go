@@ -0,0 +1,189 @@
+package qbchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Kinds of AuditIssue
+const (
+	AuditOrphanedSender   = "orphaned_sender"
+	AuditOrphanedReceiver = "orphaned_receiver"
+	AuditMismatch         = "mismatch"
+	AuditDuplicate        = "duplicate"
+)
+
+type AuditIssue struct {
+	Kind          string `json:"kind"`
+	Account       string `json:"account"`
+	BlockHash     []byte `json:"block_hash"`
+	TransactionID string `json:"transaction_id"`
+	Detail        string `json:"detail"`
+}
+
+// AuditReport is the result of checking that every transfer was written to
+// both the sender's and the receiver's chain.
+type AuditReport struct {
+	Accounts       int          `json:"accounts"`
+	SenderBlocks   int          `json:"sender_blocks"`
+	ReceiverBlocks int          `json:"receiver_blocks"`
+	Matched        int          `json:"matched"`
+	Pending        int          `json:"pending"`
+	Issues         []AuditIssue `json:"issues"`
+}
+
+func (r *AuditReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+func (r *AuditReport) addIssue(kind, account string, b *Block, detail string) {
+	issue := AuditIssue{Kind: kind, Account: account, BlockHash: b.BlockHash, Detail: detail}
+	if b.TransactionSlice != nil && len(*b.TransactionSlice) > 0 {
+		issue.TransactionID = (*b.TransactionSlice)[0].Header.TransactionID
+	}
+	r.Issues = append(r.Issues, issue)
+}
+
+type auditHalf struct {
+	account string
+	block   *Block
+}
+
+// Audit walks every account chain in the store and pairs each sender block
+// with the receiver block whose Origin is the sender block's hash.
+func Audit(db *DB) (*AuditReport, error) {
+	chains, err := db.getAllBlocks([]byte(DB_NAMESPACE))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AuditReport{Accounts: len(chains), Issues: make([]AuditIssue, 0)}
+	senders := make(map[string]auditHalf)
+	// receiver blocks by the hash of their sender block, then by account
+	receivers := make(map[string]map[string]auditHalf)
+
+	accounts := make([]string, 0, len(chains))
+	for pk := range chains {
+		accounts = append(accounts, pk)
+	}
+	sort.Strings(accounts)
+
+	for _, pk := range accounts {
+		for i := range chains[pk] {
+			b := &chains[pk][i]
+			if b.BlockHeader == nil || b.TransactionSlice == nil || len(*b.TransactionSlice) == 0 {
+				continue
+			}
+
+			if !b.IsMirror() {
+				report.SenderBlocks++
+				key := hex.EncodeToString(b.BlockHash)
+				if !bytes.Equal(b.Hash(), b.BlockHash) {
+					report.addIssue(AuditMismatch, pk, b, "block hash does not match its header")
+				}
+				if _, found := senders[key]; found {
+					report.addIssue(AuditDuplicate, pk, b, "sender block appears more than once")
+					continue
+				}
+				senders[key] = auditHalf{pk, b}
+			} else {
+				report.ReceiverBlocks++
+				key := hex.EncodeToString(b.BlockHeader.Origin)
+				if _, found := receivers[key][pk]; found {
+					report.addIssue(AuditDuplicate, pk, b, "more than one receiver block for sender block "+key)
+					continue
+				}
+				if receivers[key] == nil {
+					receivers[key] = make(map[string]auditHalf)
+				}
+				receivers[key][pk] = auditHalf{pk, b}
+			}
+		}
+	}
+
+	// A sender block is mirrored into one receiver block per receiver
+	for _, key := range sortedKeys(senders) {
+		s := senders[key]
+		sent := make(map[string][]Transaction)
+		var to []string
+		for _, t := range *s.block.TransactionSlice {
+			if _, found := sent[string(t.Header.To)]; !found {
+				to = append(to, string(t.Header.To))
+			}
+			sent[string(t.Header.To)] = append(sent[string(t.Header.To)], t)
+		}
+
+		for _, receiver := range to {
+			r, found := receivers[key][receiver]
+			if !found {
+				if _, err := db.getPendingBlock(receiver, s.block.BlockHash, []byte(DB_PENDING_NAMESPACE)); err == nil {
+					report.Pending++
+				} else {
+					report.addIssue(AuditOrphanedSender, s.account, s.block, "no receiver block in the chain of "+receiver)
+				}
+				continue
+			}
+			delete(receivers[key], receiver)
+
+			if detail := compareHalves(sent[receiver], r.block); detail != "" {
+				report.addIssue(AuditMismatch, r.account, r.block, detail)
+			} else {
+				report.Matched++
+			}
+		}
+	}
+
+	for _, key := range sortedMirrorKeys(receivers) {
+		for _, pk := range sortedKeys(receivers[key]) {
+			r := receivers[key][pk]
+			if _, found := senders[key]; found {
+				report.addIssue(AuditOrphanedReceiver, r.account, r.block, "sender block "+key+" has no transactions to "+pk)
+			} else {
+				report.addIssue(AuditOrphanedReceiver, r.account, r.block, "no sender block with hash "+key)
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// compareHalves describes how a receiver block differs from the mirror of the
+// transactions its sender block sent to the receiver, or returns "" if they
+// match.
+func compareHalves(sent []Transaction, receiver *Block) string {
+	if len(sent) != len(*receiver.TransactionSlice) {
+		return "sender and receiver blocks hold a different number of transactions"
+	}
+	for i, st := range sent {
+		rt := (*receiver.TransactionSlice)[i]
+		switch {
+		case st.Header.TransactionID != rt.Header.TransactionID:
+			return fmt.Sprintf("transaction ID %s does not match sender's %s", rt.Header.TransactionID, st.Header.TransactionID)
+		case rt.Header.Amount != -st.Header.Amount:
+			return fmt.Sprintf("amount %d is not the negation of sender's %d", rt.Header.Amount, st.Header.Amount)
+		case !bytes.Equal(st.Header.From, rt.Header.To) || !bytes.Equal(st.Header.To, rt.Header.From):
+			return "sender and receiver keys are not swapped"
+		}
+	}
+	return ""
+}
+
+func sortedMirrorKeys(m map[string]map[string]auditHalf) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(m map[string]auditHalf) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,116 @@
+package qbchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// forgeTestTransfer writes a transfer into the sender's chain and, unless
+// mirror is nil, the mirrored block into the receiver's chain.
+func forgeTestTransfer(db *DB, t Transaction, mirror func(*Transaction)) (Block, Block) {
+	sender := NewBlockchain(string(t.Header.From), db)
+	block := NewBlock(sender.latest)
+	block.AddTransaction(&t)
+	block.BlockHeader.Timestamp = t.Header.Timestamp
+	block.BlockHash = block.Hash()
+	sender.AddBlock(block, db)
+
+	rTxn := t
+	rTxn.Header.To, rTxn.Header.From = t.Header.From, t.Header.To
+	rTxn.Header.Amount = -t.Header.Amount
+	if mirror == nil {
+		return block, Block{}
+	}
+	mirror(&rTxn)
+
+	receiver := NewBlockchain(string(rTxn.Header.From), db)
+	rblock := NewBlock(receiver.latest)
+	rblock.AddTransaction(&rTxn)
+	rblock.BlockHeader.Timestamp = rTxn.Header.Timestamp
+	rblock.BlockHeader.Origin = block.BlockHash
+	rblock.BlockHash = rblock.Hash()
+	receiver.AddBlock(rblock, db)
+
+	return block, rblock
+}
+
+func TestAudit(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	alice := GenerateNewKeypair().Public
+	bob := GenerateNewKeypair().Public
+	carol := GenerateNewKeypair().Public
+
+	ok := NewTransaction(alice, bob, 100, nil)
+	ok.Header.TransactionID = "T1"
+	ok.Header.Timestamp = 1000
+	forgeTestTransfer(db, ok, func(*Transaction) {})
+
+	bad := NewTransaction(alice, carol, 50, nil)
+	bad.Header.TransactionID = "T2"
+	bad.Header.Timestamp = 1001
+	forgeTestTransfer(db, bad, func(r *Transaction) { r.Header.Amount = -40 })
+
+	lost := NewTransaction(bob, carol, 10, nil)
+	lost.Header.TransactionID = "T3"
+	lost.Header.Timestamp = 1002
+	forgeTestTransfer(db, lost, nil)
+
+	report, err := Audit(db)
+	require.NoError(err)
+	require.Equal(3, report.Accounts)
+	require.Equal(3, report.SenderBlocks)
+	require.Equal(2, report.ReceiverBlocks)
+	require.Equal(1, report.Matched)
+	require.False(report.OK())
+	require.Len(report.Issues, 2)
+
+	kinds := map[string]string{}
+	for _, issue := range report.Issues {
+		kinds[issue.TransactionID] = issue.Kind
+	}
+	require.Equal(AuditMismatch, kinds["T2"])
+	require.Equal(AuditOrphanedSender, kinds["T3"])
+}
+
+func TestAuditBatchedBlock(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	alice := GenerateNewKeypair().Public
+	bob := GenerateNewKeypair().Public
+	carol := GenerateNewKeypair().Public
+
+	sender := NewBlockchain(string(alice), db)
+	block := NewBlock(sender.latest)
+	for i, to := range [][]byte{bob, carol, bob} {
+		tx := NewTransaction(alice, to, 100, nil)
+		tx.Header.Timestamp = uint32(1000 + i)
+		block.AddTransaction(&tx)
+	}
+	block.BlockHash = block.Hash()
+	require.NoError(sender.AddBlock(block, db))
+
+	// bob accepts his mirrored block, carol's is still pending
+	held := receiverBlocks(&block)
+	require.Len(held, 2)
+	for i := range held {
+		require.NoError(db.addPendingBlock(string(held[i].Owner()), held[i], []byte(DB_PENDING_NAMESPACE)))
+	}
+	require.Len(*held[0].TransactionSlice, 2)
+	rblock := held[0]
+	rblock.BlockHash = rblock.Hash()
+	require.NoError(NewBlockchain(string(bob), db).AddBlock(rblock, db))
+
+	report, err := Audit(db)
+	require.NoError(err)
+	require.Equal(1, report.SenderBlocks)
+	require.Equal(1, report.ReceiverBlocks)
+	require.Equal(1, report.Matched)
+	require.Equal(1, report.Pending)
+	require.True(report.OK())
+}
@@ -3,25 +3,33 @@ package qbchain
 import (
 	"bytes"
 	"encoding/binary"
-	// "errors"
+	"errors"
+	"fmt"
 	// "reflect"
 	// "time"
 
 	"github.com/izqui/helpers"
 )
 
+// Block is a block of an account chain. Signer is the public key of the
+// node that forged a sender block and made its Signature. It is not part of
+// the hash, so that the validators that commit the same batch forge the same
+// block.
 type Block struct {
 	*BlockHeader
 	Signature []byte
+	Signer    []byte
 	*TransactionSlice
 	BlockHash []byte
 }
 
 type BlockHeader struct {
-	Origin    []byte
-	PrevBlock []byte
-	Timestamp uint32
-	Nonce     uint32
+	Version    uint8
+	Origin     []byte
+	PrevBlock  []byte
+	MerkleRoot []byte
+	Timestamp  uint32
+	Nonce      uint32
 }
 
 type BlockSlice []Block
@@ -40,14 +48,94 @@ func (bs *BlockSlice) AppendBlock(b Block) {
 
 }
 
+// SignedBy tells whether every block of the slice was signed by owner.
+func (bs BlockSlice) SignedBy(owner []byte) bool {
+	for i := range bs {
+		if !bs[i].SignedBy(owner) {
+			return false
+		}
+	}
+	return true
+}
+
 func NewBlock(previousBlock []byte) Block {
-	header := &BlockHeader{PrevBlock: previousBlock}
-	return Block{header, nil, new(TransactionSlice), nil}
+	header := &BlockHeader{Version: BLOCK_HEADER_VERSION, PrevBlock: previousBlock}
+	return Block{header, nil, nil, new(TransactionSlice), nil}
 }
 
 func (b *Block) AddTransaction(t *Transaction) {
 	newSlice := b.TransactionSlice.AddTransaction(*t)
 	b.TransactionSlice = &newSlice
+	b.BlockHeader.MerkleRoot = newSlice.merkleRoot(b.BlockHeader.Version)
+}
+
+// Owner returns the account whose chain the block belongs to.
+func (b *Block) Owner() []byte {
+	if b.TransactionSlice == nil || len(*b.TransactionSlice) == 0 {
+		return nil
+	}
+	return (*b.TransactionSlice)[0].Header.From
+}
+
+// verifyMerkleRoot checks that the header commits to the transactions of
+// the block, none of which may appear twice.
+func (b *Block) verifyMerkleRoot() error {
+	seen := make(map[string]bool, len(*b.TransactionSlice))
+	for _, t := range *b.TransactionSlice {
+		h := string(t.Hash())
+		if seen[h] {
+			return fmt.Errorf("transaction %s appears twice", t.Header.TransactionID)
+		}
+		seen[h] = true
+	}
+	if root := b.TransactionSlice.merkleRoot(b.BlockHeader.Version); !bytes.Equal(root, b.BlockHeader.MerkleRoot) {
+		return fmt.Errorf("merkle root %x does not match transactions root %x", b.BlockHeader.MerkleRoot, root)
+	}
+	return nil
+}
+
+// IsMirror tells whether the block is the receiver's copy of a transfer, in
+// which case Origin is the hash of the sender's block.
+func (b *Block) IsMirror() bool {
+	return b.BlockHeader != nil && len(b.BlockHeader.Origin) > 0
+}
+
+// AuthoredTransactions returns the transactions of the block as their sender
+// signed them. Mirrored blocks have From/To swapped and the amount negated,
+// which is undone here.
+func (b *Block) AuthoredTransactions() []Transaction {
+	if b.TransactionSlice == nil {
+		return nil
+	}
+
+	txns := make([]Transaction, 0, len(*b.TransactionSlice))
+	for _, t := range *b.TransactionSlice {
+		if b.IsMirror() {
+			t.Header.From, t.Header.To = t.Header.To, t.Header.From
+			t.Header.Amount = -t.Header.Amount
+		}
+		txns = append(txns, t)
+	}
+	return txns
+}
+
+// SignedBy tells whether the owner of the account chain signed the block. A
+// sender block holds transactions signed by the owner, while the block
+// itself is signed by the node that produced it. A receiver block carries the
+// owner's signature of the sender block's hash.
+func (b *Block) SignedBy(owner []byte) bool {
+	if b.BlockHeader == nil || b.TransactionSlice == nil || len(*b.TransactionSlice) == 0 {
+		return false
+	}
+	if b.IsMirror() {
+		return SignatureVerify(owner, b.Signature, b.BlockHeader.Origin)
+	}
+	for _, t := range *b.TransactionSlice {
+		if !bytes.Equal(t.Header.From, owner) || !SignatureVerify(owner, t.Signature, t.Hash()) {
+			return false
+		}
+	}
+	return true
 }
 
 func (b *Block) Sign(keypair *Keypair) []byte {
@@ -56,17 +144,33 @@ func (b *Block) Sign(keypair *Keypair) []byte {
 	return s
 }
 
+// VerifyBlock checks the proof of work of a sender block, which receiver
+// blocks do not have, that every transaction is valid and that the owner of
+// the chain signed the block, see SignedBy. Sender blocks from
+// BLOCK_SIGNER_VERSION on must also carry the signature of their Signer.
 func (b *Block) VerifyBlock(prefix []byte) bool {
-
-	headerHash := b.Hash()
-
-	return CheckProofOfWork(prefix, headerHash) && SignatureVerify(b.BlockHeader.Origin, b.Signature, headerHash)
+	if b.BlockHeader == nil || b.TransactionSlice == nil {
+		return false
+	}
+	if !b.IsMirror() {
+		if !CheckProofOfWork(prefix, b.Hash()) {
+			return false
+		}
+		if b.BlockHeader.Version >= BLOCK_SIGNER_VERSION && !SignatureVerify(b.Signer, b.Signature, b.Hash()) {
+			return false
+		}
+	}
+	for _, t := range b.AuthoredTransactions() {
+		if !t.VerifyTransaction(TRANSACTION_POW) {
+			return false
+		}
+	}
+	return b.SignedBy(b.Owner())
 }
 
 func (b *Block) Hash() []byte {
 
-	headerHash, _ := b.BlockHeader.MarshalBinary()
-	return helpers.SHA256(headerHash)
+	return b.BlockHeader.Hash()
 }
 
 func (b *Block) GenerateNonce(prefix []byte) uint32 {
@@ -91,6 +195,15 @@ func (b *Block) MarshalBinary() ([]byte, error) {
 		return nil, err
 	}
 	sig := helpers.FitBytesInto(b.Signature, NETWORK_KEY_SIZE)
+	if b.BlockHeader.Version >= BLOCK_SIGNER_VERSION {
+		w := new(binaryWriter)
+		w.bytes(b.Signer)
+		signer, err := w.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		sig = append(sig, signer...)
+	}
 	tsb, err := b.TransactionSlice.MarshalBinary()
 
 	if err != nil {
@@ -102,19 +215,30 @@ func (b *Block) MarshalBinary() ([]byte, error) {
 
 func (b *Block) UnmarshalBinary(d []byte) error {
 
-	buf := bytes.NewBuffer(d)
+	buf := bytes.NewReader(d)
 
 	header := new(BlockHeader)
-	err := header.UnmarshalBinary(buf.Next(BLOCK_HEADER_SIZE))
-	if err != nil {
+	if err := header.decode(buf); err != nil {
 		return err
 	}
+	if buf.Len() < NETWORK_KEY_SIZE {
+		return errors.New("Insuficient bytes for unmarshalling block")
+	}
 
 	b.BlockHeader = header
-	b.Signature = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
+	sig := make([]byte, NETWORK_KEY_SIZE)
+	buf.Read(sig)
+	b.Signature = helpers.StripByte(sig, 0)
+	if header.Version >= BLOCK_SIGNER_VERSION {
+		r := &binaryReader{r: buf}
+		b.Signer = r.bytes()
+		if err := r.Err(); err != nil {
+			return err
+		}
+	}
 
 	ts := new(TransactionSlice)
-	err = ts.UnmarshalBinary(buf.Next(helpers.MaxInt))
+	err := ts.UnmarshalBinary(d[len(d)-buf.Len():])
 	if err != nil {
 		return err
 	}
@@ -124,25 +248,73 @@ func (b *Block) UnmarshalBinary(d []byte) error {
 	return nil
 }
 
+// Hash is the hash of the header. Headers of version 0 predate the canonical
+// encoding and are hashed in the legacy fixed size layout.
+func (h *BlockHeader) Hash() []byte {
+
+	var headerBytes []byte
+	if h.Version == 0 {
+		headerBytes = h.legacyBytes()
+	} else {
+		headerBytes, _ = h.MarshalBinary()
+	}
+	return helpers.SHA256(headerBytes)
+}
+
+// MarshalBinary returns the canonical encoding of the header, see
+// TransactionHeader.MarshalBinary.
 func (h *BlockHeader) MarshalBinary() ([]byte, error) {
 
-	buf := new(bytes.Buffer)
+	w := new(binaryWriter)
 
-	buf.Write(helpers.FitBytesInto(h.Origin, NETWORK_KEY_SIZE))
-	binary.Write(buf, binary.LittleEndian, h.Timestamp)
-	buf.Write(helpers.FitBytesInto(h.PrevBlock, 32))
-	binary.Write(buf, binary.LittleEndian, h.Nonce)
+	w.uint8(h.Version)
+	w.bytes(h.Origin)
+	w.bytes(h.PrevBlock)
+	w.bytes(h.MerkleRoot)
+	w.uint32(h.Timestamp)
+	w.uint32(h.Nonce)
 
-	return buf.Bytes(), nil
+	return w.Bytes()
 }
 
 func (h *BlockHeader) UnmarshalBinary(d []byte) error {
 
-	buf := bytes.NewBuffer(d)
-	h.Origin = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &h.Timestamp)
-	h.PrevBlock = buf.Next(32)
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &h.Nonce)
-
+	buf := bytes.NewReader(d)
+	if err := h.decode(buf); err != nil {
+		return err
+	}
+	if buf.Len() != 0 {
+		return errors.New("trailing bytes after block header")
+	}
 	return nil
 }
+
+func (h *BlockHeader) decode(buf *bytes.Reader) error {
+
+	r := &binaryReader{r: buf}
+
+	h.Version = r.uint8()
+	if r.Err() == nil && h.Version > BLOCK_HEADER_VERSION {
+		return fmt.Errorf("unsupported block header version %d", h.Version)
+	}
+	h.Origin = r.bytes()
+	h.PrevBlock = r.bytes()
+	h.MerkleRoot = r.bytes()
+	h.Timestamp = r.uint32()
+	h.Nonce = r.uint32()
+
+	return r.Err()
+}
+
+func (h *BlockHeader) legacyBytes() []byte {
+
+	buf := new(bytes.Buffer)
+
+	buf.Write(helpers.FitBytesInto(h.Origin, NETWORK_KEY_SIZE))
+	binary.Write(buf, binary.LittleEndian, h.Timestamp)
+	buf.Write(helpers.FitBytesInto(h.PrevBlock, 32))
+	buf.Write(helpers.FitBytesInto(h.MerkleRoot, 32))
+	binary.Write(buf, binary.LittleEndian, h.Nonce)
+
+	return buf.Bytes()
+}
@@ -4,23 +4,17 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
-	"net/url"
 	// "time"
 	"log"
+	"strings"
 )
 
 type BlockchainService interface {
-	// Add a new node to the list of nodes
-	RegisterNode(address string) bool
-
-	// Determine if a given blockchain is valid
-	ValidChain(chain Blockchain) bool
-
-	// This is our Consensus Algorithm, it resolves conflicts by replacing
-	// our chain with the longest one in the network.
-	ResolveConflicts() bool
+	// This is our Consensus Algorithm, it extends an account's chain with the
+	// blocks of other nodes and quarantines the ones that conflict with it.
+	ResolveConflicts(pk string, db *DB, peers []string) bool
 
 	// Create a new Block in the Blockchain
 	AddBlock(b Block)
@@ -41,24 +35,31 @@ type BlockchainService interface {
 }
 
 type Blockchain struct {
-	chain   BlockSlice
-	balance int64
-	latest  []byte
-	nodes   StringSet
+	chain    BlockSlice
+	balances map[string]int64
+	latest   []byte
 }
 
-func (bc *Blockchain) AddBlock(b Block, db *DB) {
+func (bc *Blockchain) AddBlock(b Block, db *DB) error {
+	bc.appendBlock(b)
+	// save to DB, along with the chain info
+	return db.addBlock(bc, []byte(DB_NAMESPACE))
+}
+
+// acceptBlock adds a receiver block accepted by the owner of the chain, and
+// deletes the pending block it was accepted from along with it.
+func (bc *Blockchain) acceptBlock(b Block, db *DB) error {
+	bc.appendBlock(b)
+	return db.acceptPendingBlock(bc, []byte(DB_NAMESPACE), []byte(DB_PENDING_NAMESPACE))
+}
 
+func (bc *Blockchain) appendBlock(b Block) {
 	bc.chain = append(bc.chain, b)
-	// Sum all txns balance
+	// Sum all txns balance per currency
 	for _, tx := range *b.TransactionSlice {
-		bc.balance += tx.Header.Amount
+		bc.balances[tx.Header.Currency] += tx.Header.Amount
 	}
 	bc.latest = b.BlockHash
-	// save to DB
-	db.writeChainInfoToDB(bc, []byte(DB_NAMESPACE))
-	db.addBlock(bc, []byte(DB_NAMESPACE))
-
 }
 
 func (bc *Blockchain) NewTransaction(tx Transaction) int64 {
@@ -84,61 +85,276 @@ func (bc *Blockchain) ValidProof(lastProof, proof int64) bool {
 	return guessHash[:4] == "0000"
 }
 
-func (bc *Blockchain) ValidChain(chain *BlockSlice) bool {
-	for _, block := range *chain {
-		// Check that the hash of the block is correct
+// ChainError tells which block of a chain failed validation and why.
+type ChainError struct {
+	Index  int
+	Hash   []byte
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("block %d (%x): %s", e.Index, e.Hash, e.Reason)
+}
+
+// VerifyChain checks that the first block is a genesis block, that every
+// block commits to its transactions and links to the hash of the block
+// before it, and that every block belongs to the same account and is valid,
+// see Block.VerifyBlock.
+func VerifyChain(chain BlockSlice) error {
+	var owner []byte
+	if len(chain) > 0 {
+		owner = chain[0].Owner()
+	}
+	return VerifyAccountChain(owner, chain)
+}
+
+// VerifyAccountChain is VerifyChain for the chain of the given account.
+func VerifyAccountChain(owner []byte, chain BlockSlice) error {
+	return verifyChain(chain, func(block *Block) string {
+		if !bytes.Equal(block.Owner(), owner) {
+			return "not a block of the chain of " + string(owner)
+		}
 		if !block.VerifyBlock(BLOCK_POW) {
+			return "invalid proof of work, transaction or signature"
+		}
+		return ""
+	})
+}
+
+// verifyChain checks the structure of a chain and every block with check,
+// which returns why a block is invalid or an empty string.
+func verifyChain(chain BlockSlice, check func(block *Block) string) error {
+	for i := range chain {
+		block := &chain[i]
+		fail := func(format string, args ...interface{}) error {
+			return &ChainError{i, block.BlockHash, fmt.Sprintf(format, args...)}
+		}
+
+		if block.BlockHeader == nil || block.TransactionSlice == nil {
+			return fail("missing header or transactions")
+		}
+		if !bytes.Equal(block.Hash(), block.BlockHash) {
+			return fail("stored hash does not match header hash %x", block.Hash())
+		}
+		if err := block.verifyMerkleRoot(); err != nil {
+			return fail("%v", err)
+		}
+
+		if i == 0 {
+			if !isZeroHash(block.BlockHeader.PrevBlock) {
+				return fail("genesis block links to previous block %x", block.BlockHeader.PrevBlock)
+			}
+		} else if prev := chain[i-1].BlockHash; !bytes.Equal(block.BlockHeader.PrevBlock, prev) {
+			return fail("previous block %x does not match hash of block %d %x", block.BlockHeader.PrevBlock, i-1, prev)
+		}
+
+		if reason := check(block); reason != "" {
+			return fail("%s", reason)
+		}
+	}
+	return nil
+}
+
+// sameHash compares two block hashes, treating nil and the zero hash of a
+// genesis block's PrevBlock as equal.
+func sameHash(a, b []byte) bool {
+	return bytes.Equal(a, b) || (isZeroHash(a) && isZeroHash(b))
+}
+
+func isZeroHash(h []byte) bool {
+	for _, b := range h {
+		if b != 0 {
 			return false
 		}
 	}
 	return true
 }
 
-func (bc *Blockchain) RegisterNode(address string) bool {
-	u, err := url.Parse(address)
-	if err != nil {
-		return false
+// ResolveConflicts fetches the account's chain from every peer and offers
+// its blocks to our chain. Blocks that extend our chain are appended, blocks
+// that conflict with it are quarantined as forks: a longer chain never
+// replaces our history by itself.
+func (bc *Blockchain) ResolveConflicts(pk string, db *DB, peers []string) bool {
+	latest := bc.latest
+
+	for _, peer := range peers {
+		chain, err := requestChain(peer, pk)
+		if err != nil {
+			log.Printf("Failed to fetch the chain of %s from %s: %v", pk, peer, err)
+			continue
+		}
+
+		for i := range chain {
+			err := storeReplicatedBlock(db, &chain[i])
+			if _, forked := err.(*ForkError); err != nil && !forked {
+				log.Printf("Stopped resolving the chain of %s from %s: %v", pk, peer, err)
+				break
+			}
+		}
 	}
-	return bc.nodes.Add(u.Host)
+
+	resolved := NewBlockchain(pk, db)
+	bc.chain, bc.balances, bc.latest = resolved.chain, resolved.balances, resolved.latest
+	return !bytes.Equal(latest, bc.latest)
 }
 
-func (bc *Blockchain) ResolveConflicts() bool {
-	neighbours := bc.nodes
-	newChain := new(BlockSlice)
+// forgeBlock puts the transactions of an account that still apply, in
+// order, into the next block of its chain. The block is signed by the node
+// that produced it, with a proof of work, and the mirrored receiver blocks
+// are held until the receivers accept them, which are returned as well.
+func forgeBlock(db *DB, txns []Transaction, keypair *Keypair) (Block, []Block, error) {
+	if len(txns) == 0 {
+		return Block{}, nil, errors.New("no transactions to forge")
+	}
 
-	// We're only looking for chains longer than ours
-	maxLength := len(bc.chain)
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
 
-	// Grab and verify the chains from all the nodes in our network
-	for _, node := range neighbours.Keys() {
-		otherBlockchain, err := findExternalChain(node)
+	owner := txns[0].Header.From
+	bc := NewBlockchain(string(owner), db)
+	block := NewBlock(bc.latest)
+	statuses := make(map[string]*InvoiceStatus)
+	ids := make(map[string]bool)
+	for i := range txns {
+		t := &txns[i]
+		err := errors.New("transaction is not sent by the owner of the block")
+		if id := t.Header.TransactionID; id != "" && ids[id] {
+			err = &ConflictError{TransactionID: id}
+		} else if bytes.Equal(t.Header.From, owner) {
+			err = verifyForging(db, bc, t, statuses)
+		}
 		if err != nil {
+			log.Printf("Dropped transaction %s of %s: %v", t.Header.TransactionID, owner, err)
 			continue
 		}
+		block.AddTransaction(t)
+		block.BlockHeader.Timestamp = t.Header.Timestamp
+		ids[t.Header.TransactionID] = true
+	}
+	if len(*block.TransactionSlice) == 0 {
+		return Block{}, nil, errors.New("none of the transactions apply")
+	}
 
-		// Check if the length is longer and the chain is valid
-		if otherBlockchain.Length > maxLength && bc.ValidChain(&otherBlockchain.Chain) {
-			maxLength = otherBlockchain.Length
-			newChain = &otherBlockchain.Chain
+	block.BlockHeader.Nonce = block.GenerateNonce(BLOCK_POW)
+	block.Signature = block.Sign(keypair)
+	block.Signer = keypair.Public
+	block.BlockHash = block.Hash()
+	// The receiver blocks are held in the same transaction, so that a
+	// receiver always gets a block to accept
+	held := receiverBlocks(&block)
+	bc.appendBlock(block)
+	if err := db.addSenderBlock(bc, held, []byte(DB_NAMESPACE), []byte(DB_PENDING_NAMESPACE)); err != nil {
+		return Block{}, nil, err
+	}
+
+	return block, held, nil
+}
+
+// verifyForging checks a transaction against the chain it is forged into
+// and the invoices referenced by the transactions before it.
+func verifyForging(db *DB, bc *Blockchain, t *Transaction, statuses map[string]*InvoiceStatus) error {
+	if !t.VerifyTransaction(TRANSACTION_POW) {
+		return errors.New("invalid transaction")
+	}
+	if bc.HasTransaction(t.Hash()) {
+		return errors.New("transaction is already in the chain")
+	}
+	if _, err := findSubmission(db, t); err != nil {
+		return err
+	}
+	return verifyLifecycle(db, t, statuses)
+}
+
+// receiverBlocks mirrors a sender block into one pending block per
+// receiver, holding the receiver's transactions of the block, in the order
+// of the receivers' first transaction.
+func receiverBlocks(block *Block) []Block {
+	var receivers []string
+	rblocks := make(map[string]*Block)
+	for _, t := range *block.TransactionSlice {
+		// receiver txn
+		rTxn := t
+		rTxn.Header.To = t.Header.From
+		rTxn.Header.From = t.Header.To
+		rTxn.Header.Amount = -t.Header.Amount
+
+		to := string(rTxn.Header.From)
+		rblock, ok := rblocks[to]
+		if !ok {
+			// Hold the receiver's block until the receiver counter-signs it
+			b := NewBlock(nil)
+			b.BlockHeader.Nonce = rTxn.Header.Nonce
+			b.BlockHeader.Origin = block.BlockHash
+			rblock = &b
+			rblocks[to] = rblock
+			receivers = append(receivers, to)
 		}
+		rblock.AddTransaction(&rTxn)
+		rblock.BlockHeader.Timestamp = rTxn.Header.Timestamp
 	}
-	// Replace our chain if we discovered a new, valid chain longer than ours
-	if len(*newChain) > 0 {
-		bc.chain = *newChain
-		return true
+
+	held := make([]Block, len(receivers))
+	for i, to := range receivers {
+		held[i] = *rblocks[to]
 	}
+	return held
+}
 
+// HasTransaction tells whether a transaction with the given hash is in the chain.
+func (bc *Blockchain) HasTransaction(hash []byte) bool {
+	for _, b := range bc.chain {
+		for _, t := range b.AuthoredTransactions() {
+			if bytes.Equal(t.Hash(), hash) {
+				return true
+			}
+		}
+	}
 	return false
 }
 
+// TransactionLocation tells in which block of which account chain a
+// transaction is. A transfer is found in the chains of both parties.
+type TransactionLocation struct {
+	Account     string      `json:"account"`
+	Block       []byte      `json:"block"`
+	Timestamp   uint32      `json:"timestamp"`
+	Transaction Transaction `json:"transaction"`
+}
+
+// FindTransactions looks for the transactions with the given ID in every
+// account chain, as their senders signed them.
+func FindTransactions(db *DB, transactionID string) ([]TransactionLocation, error) {
+	keys, err := db.scanIndex(indexKey(transactionID), []byte(DB_TRANSACTIONS_INDEX_NAMESPACE))
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := db.getBlocksByKeys(keys, []byte(DB_NAMESPACE))
+	if err != nil {
+		return nil, err
+	}
+
+	var found []TransactionLocation
+	for i, b := range blocks {
+		account := keys[i][:strings.LastIndex(keys[i], "_")]
+		for _, t := range b.AuthoredTransactions() {
+			if t.Header.TransactionID == transactionID {
+				found = append(found, TransactionLocation{account, b.BlockHash, b.BlockHeader.Timestamp, t})
+			}
+		}
+	}
+	return found, nil
+}
+
 func NewBlockchain(pk string, db *DB) *Blockchain {
 	value, _ := db.getChainInfo(pk, []byte(DB_NAMESPACE))
 
 	newBlockchain := &Blockchain{
-		chain:   make([]Block, 0),
-		balance: value.Balance,
-		latest:  value.Latest,
-		nodes:   NewStringSet(),
+		chain:    make([]Block, 0),
+		balances: value.Balances,
+		latest:   value.Latest,
+	}
+	if newBlockchain.balances == nil {
+		newBlockchain.balances = make(map[string]int64)
 	}
 	db.getBlocks(newBlockchain, pk+"_", []byte(DB_NAMESPACE))
 
@@ -159,21 +375,3 @@ func computeHashForBlock(block Block) string {
 	}
 	return ComputeHashSha256(buf.Bytes())
 }
-
-type blockchainInfo struct {
-	Length  int        `json:"length"`
-	Chain   BlockSlice `json:"chain"`
-	Balance int        `json:"balance"`
-}
-
-func findExternalChain(address string) (blockchainInfo, error) {
-	response, err := http.Get(fmt.Sprintf("http://%s/chain", address))
-	if err == nil && response.StatusCode == http.StatusOK {
-		var bi blockchainInfo
-		if err := json.NewDecoder(response.Body).Decode(&bi); err != nil {
-			return blockchainInfo{}, err
-		}
-		return bi, nil
-	}
-	return blockchainInfo{}, err
-}
@@ -0,0 +1,153 @@
+package qbchain
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// makeTestChain forges n invoices of the issuer into its chain, one block
+// each, and returns the chain.
+func makeTestChain(t *testing.T, db *DB, issuer *Keypair, n int) BlockSlice {
+	buyer := GenerateNewKeypair().Public
+	for i := 0; i < n; i++ {
+		inv := makeTestInvoice()
+		inv.Number = fmt.Sprintf("INV-%04d", i+1)
+		tx, err := NewInvoiceTransaction(issuer.Public, buyer, inv)
+		require.NoError(t, err)
+		tx.Header.Timestamp = uint32(1000 * (i + 1))
+		tx.Header.Nonce = tx.GenerateNonce(TRANSACTION_POW)
+		tx.Signature = tx.Sign(issuer)
+		_, _, err = forgeBlock(db, []Transaction{tx}, GenerateNewKeypair())
+		require.NoError(t, err)
+	}
+	return NewBlockchain(string(issuer.Public), db).chain
+}
+
+func TestVerifyChain(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	require.NoError(VerifyChain(makeTestChain(t, db, GenerateNewKeypair(), 3)))
+	require.NoError(VerifyChain(BlockSlice{}))
+
+	// The receiver block of a transfer, once the receiver counter-signed it
+	issuer := GenerateNewKeypair()
+	buyer := GenerateNewKeypair()
+	_, held, err := forgeBlock(db, []Transaction{makeTestInvoiceTransaction(t, issuer, buyer.Public)}, GenerateNewKeypair())
+	require.NoError(err)
+	require.Len(held, 1)
+	received := held[0]
+	received.Signature, err = buyer.Sign(received.BlockHeader.Origin)
+	require.NoError(err)
+	received.BlockHash = received.Hash()
+	require.NoError(VerifyChain(BlockSlice{received}))
+	require.Error(VerifyAccountChain(issuer.Public, BlockSlice{received}))
+
+	received.Signature, _ = issuer.Sign(received.BlockHeader.Origin)
+	require.Error(VerifyChain(BlockSlice{received}))
+}
+
+func TestVerifyChainBrokenLink(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	chain := makeTestChain(t, db, GenerateNewKeypair(), 3)
+	chain[2].BlockHeader.PrevBlock = chain[0].BlockHash
+	chain[2].BlockHash = chain[2].Hash()
+
+	err := VerifyChain(chain)
+	require.Error(err)
+	require.Equal(2, err.(*ChainError).Index)
+	require.Contains(err.Error(), "previous block")
+}
+
+func TestVerifyChainTamperedTransaction(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	chain := makeTestChain(t, db, GenerateNewKeypair(), 2)
+	(*chain[1].TransactionSlice)[0].Header.Amount = 1000
+
+	err := VerifyChain(chain)
+	require.Error(err)
+	require.Equal(1, err.(*ChainError).Index)
+	require.Contains(err.Error(), "merkle root")
+}
+
+func TestVerifyChainGenesis(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	chain := makeTestChain(t, db, GenerateNewKeypair(), 1)
+	chain[0].BlockHeader.PrevBlock = []byte("not a genesis block")
+	chain[0].BlockHash = chain[0].Hash()
+
+	err := VerifyChain(chain)
+	require.Error(err)
+	require.Equal(0, err.(*ChainError).Index)
+}
+
+func TestVerifyAccountChain(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	issuer := GenerateNewKeypair()
+	chain := makeTestChain(t, db, issuer, 2)
+	require.Len(chain, 2)
+	require.NoError(VerifyAccountChain(issuer.Public, chain))
+	require.Error(VerifyAccountChain(GenerateNewKeypair().Public, chain))
+
+	found, err := FindTransactions(db, "INV-0002")
+	require.NoError(err)
+	require.Len(found, 1)
+	require.Equal(string(issuer.Public), found[0].Account)
+	require.Equal(chain[1].BlockHash, found[0].Block)
+
+	(*chain[1].TransactionSlice)[0].Header.Amount++
+	chain[1].BlockHeader.MerkleRoot = chain[1].TransactionSlice.MerkleRoot()
+	chain[1].BlockHash = chain[1].Hash()
+	err = VerifyAccountChain(issuer.Public, chain)
+	require.Error(err)
+	require.Equal(1, err.(*ChainError).Index)
+}
+
+func TestMerkleRoot(t *testing.T) {
+	require := require.New(t)
+
+	require.Nil(TransactionSlice{}.MerkleRoot())
+
+	a := NewTransaction([]byte("a"), []byte("b"), 1, nil)
+	b := NewTransaction([]byte("a"), []byte("b"), 2, nil)
+	c := NewTransaction([]byte("a"), []byte("b"), 3, nil)
+	leaf := func(t Transaction) []byte { return merkleLeaf(t.Hash(), BLOCK_HEADER_VERSION) }
+	parent := func(l, r []byte) []byte { return merkleParent(l, r, BLOCK_HEADER_VERSION) }
+
+	require.Equal(leaf(a), TransactionSlice{a}.MerkleRoot())
+	require.Equal(parent(leaf(a), leaf(b)), TransactionSlice{a, b}.MerkleRoot())
+	require.Equal(parent(parent(leaf(a), leaf(b)), leaf(c)), TransactionSlice{a, b, c}.MerkleRoot())
+
+	// Repeating the odd transaction changes the root, unlike in old blocks
+	require.NotEqual(TransactionSlice{a, b, c}.MerkleRoot(), TransactionSlice{a, b, c, c}.MerkleRoot())
+	require.Equal(TransactionSlice{a, b, c}.merkleRoot(1), TransactionSlice{a, b, c, c}.merkleRoot(1))
+	require.Equal(merkleParent(merkleParent(a.Hash(), b.Hash(), 1), merkleParent(c.Hash(), c.Hash(), 1), 1),
+		TransactionSlice{a, b, c}.merkleRoot(1))
+
+	// Blocks cannot hold a transaction twice
+	block := NewBlock(nil)
+	for _, t := range []Transaction{a, b, c, c} {
+		block.AddTransaction(&t)
+	}
+	require.Error(block.verifyMerkleRoot())
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	".."
+)
+
+const (
+	KEYSTORE_ENV   = "QB_KEYSTORE"
+	KEYSTORE_FILE  = "keystore.json"
+	PASSPHRASE_ENV = "QB_PASSPHRASE"
+)
+
+// stdin is shared by every prompt, so that answers piped to the CLI are not
+// lost in the buffer of another reader.
+var stdin = bufio.NewReader(os.Stdin)
+
+// Keystore maps the aliases of the user's keys to their encrypted keypairs.
+// Only the public keys can be read without a passphrase.
+type Keystore struct {
+	path string
+	Keys map[string]*qbchain.EncryptedKeypair `json:"keys"`
+}
+
+// keystorePath is $QB_KEYSTORE, or keystore.json in the qb directory of the
+// user's config dir.
+func keystorePath() (string, error) {
+	if path := os.Getenv(KEYSTORE_ENV); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "qb", KEYSTORE_FILE), nil
+}
+
+func OpenKeystore() (*Keystore, error) {
+	path, err := keystorePath()
+	if err != nil {
+		return nil, err
+	}
+	ks := &Keystore{path: path, Keys: make(map[string]*qbchain.EncryptedKeypair)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, ks); err != nil {
+		return nil, fmt.Errorf("invalid keystore %s: %v", path, err)
+	}
+	if ks.Keys == nil {
+		ks.Keys = make(map[string]*qbchain.EncryptedKeypair)
+	}
+	return ks, nil
+}
+
+// save replaces the keystore file, readable by the user only.
+func (ks *Keystore) save() error {
+	if err := os.MkdirAll(filepath.Dir(ks.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ks.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ks.path)
+}
+
+func (ks *Keystore) Aliases() []string {
+	aliases := make([]string, 0, len(ks.Keys))
+	for alias := range ks.Keys {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// Add encrypts a keypair under a new alias.
+func (ks *Keystore) Add(alias string, kp *qbchain.Keypair, passphrase string) error {
+	if alias == "" || strings.ContainsAny(alias, " \t\n") {
+		return fmt.Errorf("invalid alias %q", alias)
+	}
+	if _, ok := ks.Keys[alias]; ok {
+		return fmt.Errorf("key %s already exists", alias)
+	}
+	e, err := qbchain.EncryptKeypair(kp, passphrase)
+	if err != nil {
+		return err
+	}
+	ks.Keys[alias] = e
+	return ks.save()
+}
+
+func (ks *Keystore) Unlock(alias, passphrase string) (*qbchain.Keypair, error) {
+	e, ok := ks.Keys[alias]
+	if !ok {
+		return nil, fmt.Errorf("no key %s in %s", alias, ks.path)
+	}
+	return e.Decrypt(passphrase)
+}
+
+func (ks *Keystore) Delete(alias string) error {
+	if _, ok := ks.Keys[alias]; !ok {
+		return fmt.Errorf("no key %s in %s", alias, ks.path)
+	}
+	delete(ks.Keys, alias)
+	return ks.save()
+}
+
+// unlockKey asks for the passphrase of a key in the keystore, unless it is
+// given by $QB_PASSPHRASE for scripts.
+func unlockKey(alias string) (*qbchain.Keypair, error) {
+	if alias == "" {
+		return nil, errors.New("-from <alias> is required, see qb keys")
+	}
+	ks, err := OpenKeystore()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ks.Keys[alias]; !ok {
+		return nil, fmt.Errorf("no key %s in %s", alias, ks.path)
+	}
+	if passphrase := os.Getenv(PASSPHRASE_ENV); passphrase != "" {
+		return ks.Unlock(alias, passphrase)
+	}
+	passphrase, err := readSecret("Passphrase of " + alias + ": ")
+	if err != nil {
+		return nil, err
+	}
+	return ks.Unlock(alias, passphrase)
+}
+
+// readSecret reads a line without echoing it when stdin is a terminal.
+func readSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimSpace(line), nil
+	}
+	secret, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return strings.TrimSpace(string(secret)), err
+}
+
+func readNewPassphrase() (string, error) {
+	passphrase, err := readSecret("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("the passphrase must not be empty")
+	}
+	again, err := readSecret("Repeat passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if again != passphrase {
+		return "", errors.New("the passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// keysCommand manages the keystore: keys new|list|import|export|delete.
+func keysCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New("new|list|import|export|delete is required")
+	}
+	ks, err := OpenKeystore()
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "list" {
+		for _, alias := range ks.Aliases() {
+			fmt.Printf("%s\t%s\n", alias, ks.Keys[alias].Public)
+		}
+		return nil
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("usage: qb keys %s <alias>", args[0])
+	}
+	alias := args[1]
+
+	switch args[0] {
+	case "new", "import":
+		if _, ok := ks.Keys[alias]; ok {
+			return fmt.Errorf("key %s already exists", alias)
+		}
+		kp := qbchain.GenerateNewKeypair()
+		if args[0] == "import" {
+			private, err := readSecret("Private Key: ")
+			if err != nil {
+				return err
+			}
+			if kp, err = qbchain.KeypairFromPrivate([]byte(private)); err != nil {
+				return err
+			}
+		}
+		passphrase, err := readNewPassphrase()
+		if err != nil {
+			return err
+		}
+		if err := ks.Add(alias, kp, passphrase); err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\n", alias, kp.Public)
+	case "export":
+		kp, err := unlockKey(alias)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Public Key : %s\nPrivate Key: %s\n", kp.Public, kp.Private)
+	case "delete":
+		// Deleting a key requires its passphrase, as exporting it does
+		if _, err := unlockKey(alias); err != nil {
+			return err
+		}
+		return ks.Delete(alias)
+	default:
+		return fmt.Errorf("unknown keys command %s", args[0])
+	}
+	return nil
+}
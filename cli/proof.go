@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	".."
+	"../client"
+)
+
+// verifyProof fetches the inclusion proof of a transaction from the node, or
+// reads it from a file, and checks it locally against the head the user
+// expects, as the node supplies the headers the proof is checked against.
+func verifyProof(pk, id, file, head string) error {
+	if pk == "" || id == "" || head == "" {
+		return errors.New("usage: qb verify-proof -pk <account-key> -id <transaction-id> -head <hex-head-hash> [-file proof.json]")
+	}
+
+	var proof *qbchain.InclusionProof
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		proof = new(qbchain.InclusionProof)
+		if err := json.Unmarshal(data, proof); err != nil {
+			return fmt.Errorf("invalid proof: %s", err)
+		}
+	} else {
+		var err error
+		if proof, err = client.New(nodeURL).Proof(pk, id); err != nil {
+			return err
+		}
+	}
+
+	if err := proof.Verify(pk, id); err != nil {
+		return err
+	}
+	if hex.EncodeToString(proof.Head) != head {
+		return fmt.Errorf("proof ends at head %x, expected %s", proof.Head, head)
+	}
+
+	fmt.Printf("Transaction %s is included in the chain of %s with head %x\n",
+		proof.Transaction.Header.TransactionID, proof.Account, proof.Head)
+	return nil
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
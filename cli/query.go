@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	".."
+	"../client"
+)
+
+// ChainVerification is the outcome of qb verify.
+type ChainVerification struct {
+	Account string `json:"account"`
+	Blocks  int    `json:"blocks"`
+	Valid   bool   `json:"valid"`
+	Index   *int   `json:"index,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Sender blocks forged before blocks carried the key of their node,
+	// whose node signature cannot be verified
+	UnsignedByNode int `json:"unsigned_by_node"`
+}
+
+// queryFlags parses the flags of a read command around its single argument,
+// so that both "qb chain -o json <pk>" and "qb chain <pk> -o json" work.
+func queryFlags(name string, args []string) (arg, output string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&output, "o", "table", "output format, table or json")
+	fs.StringVar(&nodeURL, "node-url", nodeURL, "base URL of the node")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		arg = fs.Arg(0)
+		fs.Parse(fs.Args()[1:])
+	}
+	if arg == "" || fs.NArg() > 0 {
+		exitOnError(fmt.Errorf("usage: qb %s [-o table|json] [-node-url url] <argument>", name))
+	}
+	if output != "table" && output != "json" {
+		exitOnError(fmt.Errorf("unknown output format %q", output))
+	}
+	return arg, output
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func formatTime(timestamp uint32) string {
+	return time.Unix(int64(timestamp), 0).UTC().Format(time.RFC3339)
+}
+
+func shortHash(h []byte) string {
+	s := hex.EncodeToString(h)
+	if len(s) > 16 {
+		return s[:16]
+	}
+	return s
+}
+
+// chainCommand lists the blocks of an account chain.
+func chainCommand(args []string) {
+	pk, output := queryFlags("chain", args)
+	resp, err := client.New(nodeURL).Chain(pk)
+	exitOnError(err)
+	if output == "json" {
+		printJSON(resp)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tHASH\tPREV\tTIME\tTYPE\tTXNS")
+	for i, b := range resp.Chain {
+		kind := "sent"
+		if b.IsMirror() {
+			kind = "received"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\n", i, shortHash(b.BlockHash), shortHash(b.BlockHeader.PrevBlock),
+			formatTime(b.BlockHeader.Timestamp), kind, len(*b.TransactionSlice))
+	}
+	w.Flush()
+}
+
+// balanceCommand shows the balances of an account by currency.
+func balanceCommand(args []string) {
+	pk, output := queryFlags("balance", args)
+	resp, err := client.New(nodeURL).Chain(pk)
+	exitOnError(err)
+	if output == "json" {
+		printJSON(resp.Balances)
+		return
+	}
+
+	currencies := make([]string, 0, len(resp.Balances))
+	for currency := range resp.Balances {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "CURRENCY\tBALANCE\t")
+	for _, currency := range currencies {
+		fmt.Fprintf(w, "%s\t%s\t\n", currency, qbchain.FormatAmount(resp.Balances[currency], currency))
+	}
+	w.Flush()
+}
+
+// txCommand looks up a transaction by ID in every chain of the node.
+func txCommand(args []string) {
+	id, output := queryFlags("tx", args)
+	found, err := client.New(nodeURL).Transactions(id)
+	exitOnError(err)
+	if output == "json" {
+		printJSON(found)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tBLOCK\tTIME\tKIND\tFROM\tTO\tAMOUNT")
+	for _, l := range found {
+		h := l.Transaction.Header
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", l.Account, shortHash(l.Block), formatTime(h.Timestamp),
+			h.Kind, h.From, h.To, qbchain.FormatAmount(h.Amount, h.Currency))
+	}
+	w.Flush()
+}
+
+// verifyCommand fetches an account chain and checks every block locally
+// with the checks of the node, so that the node does not have to be
+// trusted. It exits with EXIT_REJECTED when the chain is invalid.
+func verifyCommand(args []string) {
+	pk, output := queryFlags("verify", args)
+	resp, err := client.New(nodeURL).Chain(pk)
+	exitOnError(err)
+
+	// Transaction verification logs every check
+	log.SetOutput(ioutil.Discard)
+	v := ChainVerification{Account: pk, Blocks: len(resp.Chain), Valid: true}
+	if err := qbchain.VerifyAccountChain([]byte(pk), resp.Chain); err != nil {
+		v.Valid, v.Error = false, err.Error()
+		if chainErr, ok := err.(*qbchain.ChainError); ok {
+			v.Index = &chainErr.Index
+		}
+	}
+	for _, b := range resp.Chain {
+		if b.BlockHeader != nil && !b.IsMirror() && b.BlockHeader.Version < qbchain.BLOCK_SIGNER_VERSION {
+			v.UnsignedByNode++
+		}
+	}
+
+	if output == "json" {
+		printJSON(v)
+	} else if v.Valid {
+		fmt.Printf("Chain of %s is valid, %d blocks\n", pk, v.Blocks)
+	} else {
+		fmt.Printf("Chain of %s is invalid: %s\n", pk, v.Error)
+	}
+	if output != "json" && v.UnsignedByNode > 0 {
+		fmt.Printf("Node signatures of %d blocks are not verified: they do not carry the key of the node that forged them\n", v.UnsignedByNode)
+	}
+	if !v.Valid {
+		os.Exit(EXIT_REJECTED)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	".."
+	"../client"
+)
+
+const (
+	// Exit codes of the CLI: a rejection by the node is told apart from an
+	// error of the CLI itself, e.g. an invalid flag or an unreachable node.
+	EXIT_ERROR    = 1
+	EXIT_REJECTED = 2
+)
+
+// nodeURL is the base URL of the node the CLI talks to, set by -node-url.
+var nodeURL = client.DEFAULT_URL
+
+// SubmitRequest describes a transaction to submit, from the flags of qb
+// submit or from a line of a JSON Lines file.
+type SubmitRequest struct {
+	To            string `json:"to"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	CompanyID     string `json:"company_id"`
+	TransactionID string `json:"transaction_id"`
+	Kind          string `json:"kind"`
+	Reference     string `json:"reference"`
+	Payload       string `json:"payload"`
+	PayloadFile   string `json:"payload_file"`
+}
+
+// TransactionRequest reads the payload file, if any, of the request.
+func (r *SubmitRequest) TransactionRequest() (client.TransactionRequest, error) {
+	req := client.TransactionRequest{
+		To:            []byte(r.To),
+		Amount:        r.Amount,
+		Currency:      r.Currency,
+		CompanyID:     r.CompanyID,
+		TransactionID: r.TransactionID,
+		Reference:     r.Reference,
+		Payload:       []byte(r.Payload),
+	}
+	if r.Kind != "" {
+		kind, err := qbchain.ParseTransactionKind(r.Kind)
+		if err != nil {
+			return req, err
+		}
+		req.Kind = kind
+	}
+
+	if r.PayloadFile != "" {
+		if r.Payload != "" {
+			return req, errors.New("payload and payload file are exclusive")
+		}
+		payload, err := ioutil.ReadFile(r.PayloadFile)
+		if err != nil {
+			return req, err
+		}
+		req.Payload = payload
+	}
+	return req, nil
+}
+
+// Result is printed as one JSON line for every request sent to the node.
+type Result struct {
+	TransactionID string          `json:"transaction_id,omitempty"`
+	Status        int             `json:"status"`
+	OK            bool            `json:"ok"`
+	Response      json.RawMessage `json:"response,omitempty"`
+	Error         string          `json:"error,omitempty"`
+}
+
+func printResult(r Result) {
+	json.NewEncoder(os.Stdout).Encode(r)
+}
+
+// exitCode tells how the CLI exits after the results of its requests.
+func exitCode(results []Result) int {
+	code := 0
+	for _, r := range results {
+		if r.Status == 0 {
+			return EXIT_ERROR
+		}
+		if !r.OK {
+			code = EXIT_REJECTED
+		}
+	}
+	return code
+}
+
+// newResult tells how the node answered a request: resp on success, or
+// err, which holds the status and message of a rejection.
+func newResult(id string, status int, resp interface{}, err error) Result {
+	r := Result{TransactionID: id, Status: status, OK: err == nil}
+	if e, ok := err.(*client.Error); ok {
+		r.Status = e.StatusCode
+		r.Response, _ = json.Marshal(e.Message)
+	} else if err != nil {
+		r.Error = err.Error()
+	} else {
+		r.Response, _ = json.Marshal(resp)
+	}
+	return r
+}
+
+func submit(c *client.Client, r *SubmitRequest, kp *qbchain.Keypair) Result {
+	req, err := r.TransactionRequest()
+	if err != nil {
+		return Result{TransactionID: r.TransactionID, Error: err.Error()}
+	}
+	txn, err := client.NewTransaction(kp, req)
+	if err != nil {
+		return Result{TransactionID: r.TransactionID, Error: err.Error()}
+	}
+	// The ID of an invoice may come from its payload
+	id := txn.Header.TransactionID
+	resp, err := c.Submit(txn)
+	if err != nil {
+		return newResult(id, 0, nil, err)
+	}
+	return newResult(id, resp.StatusCode, resp, nil)
+}
+
+// submitFile submits every line of a JSON Lines file, or of stdin for "-".
+// A line that cannot be submitted does not stop the ones after it.
+func submitFile(c *client.Client, path string, kp *qbchain.Keypair) ([]Result, error) {
+	var in io.Reader = stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var results []Result
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var req SubmitRequest
+		var r Result
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			r = Result{Error: fmt.Sprintf("line %d: %v", line, err)}
+		} else {
+			r = submit(c, &req, kp)
+		}
+		printResult(r)
+		results = append(results, r)
+	}
+	return results, scanner.Err()
+}
+
+// submitCommand signs and submits transactions with a key of the keystore
+// and returns the exit code of the CLI.
+func submitCommand(args []string) int {
+	var req SubmitRequest
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
+	from := fs.String("from", "", "alias of the sender key in the keystore")
+	file := fs.String("f", "", "submit every request of a JSON Lines file, - for stdin")
+	fs.StringVar(&nodeURL, "node-url", nodeURL, "base URL of the node")
+	fs.StringVar(&req.To, "to", "", "public key of the receiver")
+	fs.Int64Var(&req.Amount, "amount", 0, "amount in minor units of the currency")
+	fs.StringVar(&req.Currency, "currency", "", "ISO 4217 currency code")
+	fs.StringVar(&req.CompanyID, "company", "", "company ID")
+	fs.StringVar(&req.TransactionID, "txid", "", "transaction ID")
+	fs.StringVar(&req.Kind, "kind", "invoice", "invoice, acknowledge, payment, dispute or void")
+	fs.StringVar(&req.Reference, "ref", "", "transaction ID of the invoice of a follow-up")
+	fs.StringVar(&req.Payload, "payload", "", "payload of the transaction")
+	fs.StringVar(&req.PayloadFile, "payload-file", "", "read the payload from a file, the JSON of an invoice")
+	fs.Parse(args)
+
+	kp, err := unlockKey(*from)
+	if err != nil {
+		printResult(Result{Error: err.Error()})
+		return EXIT_ERROR
+	}
+
+	c := client.New(nodeURL)
+	if *file == "" {
+		r := submit(c, &req, kp)
+		printResult(r)
+		return exitCode([]Result{r})
+	}
+	results, err := submitFile(c, *file, kp)
+	if err != nil {
+		printResult(Result{Error: err.Error()})
+		return EXIT_ERROR
+	}
+	return exitCode(results)
+}
+
+// acceptCommand counter-signs a pending block in the receiver's chain. The
+// sender block hash is the base64 "Origin" of the pending block.
+func acceptCommand(args []string) int {
+	fs := flag.NewFlagSet("accept", flag.ExitOnError)
+	from := fs.String("from", "", "alias of the receiver key in the keystore")
+	origin := fs.String("origin", "", "base64 hash of the sender block")
+	fs.StringVar(&nodeURL, "node-url", nodeURL, "base URL of the node")
+	fs.Parse(args)
+
+	hash, err := base64.StdEncoding.DecodeString(*origin)
+	if err == nil && len(hash) == 0 {
+		err = errors.New("-origin is required")
+	}
+	var kp *qbchain.Keypair
+	if err == nil {
+		kp, err = unlockKey(*from)
+	}
+	var a qbchain.Acceptance
+	if err == nil {
+		a, err = client.NewAcceptance(kp, hash)
+	}
+	if err != nil {
+		printResult(Result{Error: err.Error()})
+		return EXIT_ERROR
+	}
+
+	var r Result
+	if resp, err := client.New(nodeURL).Accept(a); err != nil {
+		r = newResult("", 0, nil, err)
+	} else {
+		r = newResult("", resp.StatusCode, resp, nil)
+	}
+	printResult(r)
+	return exitCode([]Result{r})
+}
@@ -0,0 +1,176 @@
+// Package client talks to the HTTP API of a qbchain node, and is what the qb
+// CLI is built on. It signs transactions and acceptances with the same code
+// as the node, so that the CLI and the node always agree on their hashes.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	".."
+)
+
+const DEFAULT_URL = "http://127.0.0.1:8000"
+
+// Client calls the API of the node at URL.
+type Client struct {
+	URL  string
+	HTTP *http.Client
+}
+
+func New(url string) *Client {
+	if url == "" {
+		url = DEFAULT_URL
+	}
+	return &Client{strings.TrimRight(url, "/"), http.DefaultClient}
+}
+
+// Error is returned when the node answers with a status other than 2xx.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// SubmitResponse is the answer to a new transaction. The node either forged
+// it into Block right away, or holds it in its mempool or submitted it for
+// ordering, in which case Block is nil.
+type SubmitResponse struct {
+	StatusCode           int                  `json:"-"`
+	Message              string               `json:"message"`
+	Transaction          *qbchain.Transaction `json:"transaction,omitempty"`
+	Block                *qbchain.Block       `json:"block,omitempty"`
+	PendingReceiverBlock *qbchain.Block       `json:"pendingReceiverBlock,omitempty"`
+}
+
+// AcceptResponse is the answer to an acceptance, with the receiver block it
+// added to the receiver's chain.
+type AcceptResponse struct {
+	StatusCode int            `json:"-"`
+	Message    string         `json:"message"`
+	Block      *qbchain.Block `json:"block"`
+}
+
+// Chain is an account chain with the balances of the account by currency.
+type Chain struct {
+	Chain    qbchain.BlockSlice `json:"chain"`
+	Length   int                `json:"length"`
+	Balances map[string]int64   `json:"balances"`
+}
+
+// Submit sends a signed transaction to the node.
+func (c *Client) Submit(t qbchain.Transaction) (*SubmitResponse, error) {
+	var resp SubmitResponse
+	status, err := c.do(http.MethodPost, "/transactions/new", t, &resp)
+	if err != nil {
+		return nil, err
+	}
+	resp.StatusCode = status
+	return &resp, nil
+}
+
+// Accept sends the counter-signature of a pending block to the node.
+func (c *Client) Accept(a qbchain.Acceptance) (*AcceptResponse, error) {
+	var resp AcceptResponse
+	status, err := c.do(http.MethodPost, "/transactions/accept", a, &resp)
+	if err != nil {
+		return nil, err
+	}
+	resp.StatusCode = status
+	return &resp, nil
+}
+
+func (c *Client) Chain(pk string) (*Chain, error) {
+	var chain Chain
+	if _, err := c.do(http.MethodGet, "/chain?pk="+url.QueryEscape(pk), nil, &chain); err != nil {
+		return nil, err
+	}
+	return &chain, nil
+}
+
+// Transactions looks up a transaction by ID in every chain of the node.
+func (c *Client) Transactions(id string) ([]qbchain.TransactionLocation, error) {
+	var found []qbchain.TransactionLocation
+	if _, err := c.do(http.MethodGet, "/transactions?id="+url.QueryEscape(id), nil, &found); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// Pending lists the blocks waiting for the acceptance of a receiver.
+func (c *Client) Pending(pk string) ([]qbchain.Block, error) {
+	var resp struct {
+		Pending []qbchain.Block `json:"pending"`
+	}
+	if _, err := c.do(http.MethodGet, "/transactions/pending?pk="+url.QueryEscape(pk), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Pending, nil
+}
+
+// Proof fetches the inclusion proof of a transaction. Callers should Verify
+// it and compare its Head with a head they obtained independently.
+func (c *Client) Proof(pk, id string) (*qbchain.InclusionProof, error) {
+	var proof qbchain.InclusionProof
+	path := "/proof?pk=" + url.QueryEscape(pk) + "&id=" + url.QueryEscape(id)
+	if _, err := c.do(http.MethodGet, path, nil, &proof); err != nil {
+		return nil, err
+	}
+	return &proof, nil
+}
+
+func (c *Client) NodeInfo() (*qbchain.NodeInfo, error) {
+	var info qbchain.NodeInfo
+	if _, err := c.do(http.MethodGet, "/node/info", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// do sends in as JSON, if any, and decodes the answer into out. The node
+// answers an error with a JSON string, which is returned as an *Error.
+func (c *Client) do(method, path string, in, out interface{}) (int, error) {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, c.URL+path, &body)
+	if err != nil {
+		return 0, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		var msg string
+		if json.Unmarshal(data, &msg) != nil {
+			msg = strings.TrimSpace(string(data))
+		}
+		return resp.StatusCode, &Error{resp.StatusCode, msg}
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return resp.StatusCode, fmt.Errorf("invalid response from %s: %v", path, err)
+	}
+	return resp.StatusCode, nil
+}
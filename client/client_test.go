@@ -0,0 +1,116 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	".."
+)
+
+func makeNode(t *testing.T) (*qbchain.Keypair, *Client, func()) {
+	tmpDir, err := ioutil.TempDir("", "db-client-test")
+	require.NoError(t, err)
+	db, err := qbchain.New(path.Join(tmpDir, "data"), path.Join(tmpDir, "meta"))
+	require.NoError(t, err)
+
+	node := qbchain.GenerateNewKeypair()
+	server := httptest.NewServer(qbchain.NewHandler(node, db, nil, nil, nil, nil, nil))
+	return node, New(server.URL), func() {
+		server.Close()
+		db.Close()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestNewTransaction(t *testing.T) {
+	require := require.New(t)
+
+	kp := qbchain.GenerateNewKeypair()
+	buyer := qbchain.GenerateNewKeypair().Public
+	tx, err := NewTransaction(kp, TransactionRequest{
+		To:            buyer,
+		Amount:        500,
+		Currency:      "usd",
+		CompanyID:     "GLOBEX",
+		TransactionID: "PAY-1",
+		Kind:          qbchain.KindPayment,
+		Reference:     "INV-0001",
+	})
+	require.NoError(err)
+	require.True(tx.VerifyTransaction(qbchain.TRANSACTION_POW))
+	require.Equal("USD", tx.Header.Currency)
+	require.Equal("GLOBEX", tx.Header.CompanyID)
+	require.Equal(uint8(qbchain.TRANSACTION_HEADER_VERSION), tx.Header.Version)
+
+	// An invoice is encoded canonically, and its header taken from it
+	invoice := []byte(`{
+  "number": "INV-0001",
+  "issuer_company_id": "ACME",
+  "buyer_company_id": "GLOBEX",
+  "currency": "USD",
+  "issue_date": "2018-06-01",
+  "due_date": "2018-07-01",
+  "line_items": [{"description": "Widgets", "quantity": 3, "unit_price": 1000, "tax": 240}]
+}
+`)
+	inv, err := NewTransaction(kp, TransactionRequest{To: buyer, Payload: invoice})
+	require.NoError(err)
+	require.NoError(inv.VerifyInvoice())
+	require.Equal(int64(3240), inv.Header.Amount)
+	require.Equal("USD", inv.Header.Currency)
+	require.Equal("ACME", inv.Header.CompanyID)
+	require.Equal("INV-0001", inv.Header.TransactionID)
+	_, err = NewTransaction(kp, TransactionRequest{To: buyer, Amount: 1000, Payload: invoice})
+	require.Error(err)
+	_, err = NewTransaction(kp, TransactionRequest{To: buyer, TransactionID: "INV-0002", Payload: invoice})
+	require.Error(err)
+
+	// Follow-ups must reference their invoice
+	_, err = NewTransaction(kp, TransactionRequest{To: buyer, TransactionID: "PAY-2", Kind: qbchain.KindPayment})
+	require.Error(err)
+
+	a, err := NewAcceptance(kp, tx.Hash())
+	require.NoError(err)
+	require.True(qbchain.SignatureVerify(kp.Public, a.Signature, a.Origin))
+
+	res, err := NewForkResolution(kp, "f0", "branch")
+	require.NoError(err)
+	require.True(qbchain.SignatureVerify(kp.Public, res.Signature, res.Hash()))
+	res.Keep = "local"
+	require.False(qbchain.SignatureVerify(kp.Public, res.Signature, res.Hash()))
+}
+
+func TestClient(t *testing.T) {
+	require := require.New(t)
+
+	node, c, cleanup := makeNode(t)
+	defer cleanup()
+
+	info, err := c.NodeInfo()
+	require.NoError(err)
+	require.Equal(string(node.Public), info.PublicKey)
+
+	kp := qbchain.GenerateNewKeypair()
+	chain, err := c.Chain(string(kp.Public))
+	require.NoError(err)
+	require.Empty(chain.Chain)
+
+	// Rejections come back with the status and message of the node
+	tx, err := NewTransaction(kp, TransactionRequest{To: node.Public, TransactionID: "INV-1"})
+	require.NoError(err)
+	tx.Header.Version = 0
+	_, err = c.Submit(tx)
+	require.IsType(&Error{}, err)
+	require.Equal(http.StatusBadRequest, err.(*Error).StatusCode)
+	require.Contains(err.(*Error).Message, "Unsupported transaction header version")
+
+	_, err = c.Transactions("INV-1")
+	require.IsType(&Error{}, err)
+	require.Equal(http.StatusNotFound, err.(*Error).StatusCode)
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	".."
+)
+
+// TransactionRequest describes a transaction of the sender. Every kind but
+// an invoice refers to the invoice it follows up with Reference. The payload
+// of an invoice is its JSON, which NewTransaction encodes canonically.
+type TransactionRequest struct {
+	To            []byte
+	Amount        int64
+	Currency      string
+	CompanyID     string
+	TransactionID string
+	Kind          qbchain.TransactionKind
+	Reference     string
+	Payload       []byte
+}
+
+// NewTransaction builds the transaction of a request with its proof of work,
+// signed by the sender. The amount, currency, company and transaction ID of
+// an invoice default to those of its payload.
+func NewTransaction(kp *qbchain.Keypair, r TransactionRequest) (qbchain.Transaction, error) {
+	if r.Kind == qbchain.KindInvoice && len(r.Payload) > 0 {
+		if err := r.invoice(); err != nil {
+			return qbchain.Transaction{}, err
+		}
+	}
+	if len(r.To) == 0 || r.TransactionID == "" {
+		return qbchain.Transaction{}, errors.New("receiver and transaction ID are required")
+	}
+	if r.Kind != qbchain.KindInvoice && r.Reference == "" {
+		return qbchain.Transaction{}, fmt.Errorf("a %s must reference an invoice", r.Kind)
+	}
+
+	t := qbchain.NewFollowUpTransaction(kp.Public, r.To, r.Kind, r.Reference, r.TransactionID, r.Amount, strings.ToUpper(r.Currency), r.Payload)
+	t.Header.CompanyID = r.CompanyID
+	Sign(&t, kp)
+	return t, nil
+}
+
+// invoice replaces the payload of an invoice request with its canonical
+// encoding, and fills in the header fields the invoice determines.
+func (r *TransactionRequest) invoice() error {
+	var inv qbchain.Invoice
+	dec := json.NewDecoder(bytes.NewReader(r.Payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&inv); err != nil {
+		return fmt.Errorf("invalid invoice payload: %v", err)
+	}
+	if err := inv.Validate(); err != nil {
+		return err
+	}
+	payload, err := inv.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	total, _ := inv.Total()
+
+	if r.Amount == 0 {
+		r.Amount = total
+	}
+	if r.Currency == "" {
+		r.Currency = inv.Currency
+	}
+	if r.CompanyID == "" {
+		r.CompanyID = inv.IssuerCompanyID
+	}
+	if r.TransactionID == "" {
+		r.TransactionID = inv.Number
+	}
+	if r.Amount != total || !strings.EqualFold(r.Currency, inv.Currency) {
+		return fmt.Errorf("amount %d %s does not match invoice total %d %s", r.Amount, r.Currency, total, inv.Currency)
+	}
+	if r.CompanyID != inv.IssuerCompanyID || r.TransactionID != inv.Number {
+		return fmt.Errorf("company %q and transaction ID %q do not match invoice issuer %q and number %q", r.CompanyID, r.TransactionID, inv.IssuerCompanyID, inv.Number)
+	}
+	r.Payload = payload
+	return nil
+}
+
+// NewForkResolution signs the choice of the branch of fork id to keep,
+// "local" or "branch", with the key of the account owner.
+func NewForkResolution(kp *qbchain.Keypair, id, keep string) (qbchain.ForkResolution, error) {
+	res := qbchain.ForkResolution{PublicKey: kp.Public, ID: id, Keep: keep}
+	sig, err := kp.Sign(res.Hash())
+	if err != nil {
+		return qbchain.ForkResolution{}, err
+	}
+	res.Signature = sig
+	return res, nil
+}
+
+// Sign generates the proof of work of a transaction and signs it. The
+// header must not change afterwards.
+func Sign(t *qbchain.Transaction, kp *qbchain.Keypair) {
+	t.Header.Nonce = t.GenerateNonce(qbchain.TRANSACTION_POW)
+	t.Signature = t.Sign(kp)
+}
+
+// NewAcceptance counter-signs the pending block whose sender block hash is
+// origin, to add it to the receiver's chain.
+func NewAcceptance(kp *qbchain.Keypair, origin []byte) (qbchain.Acceptance, error) {
+	sig, err := kp.Sign(origin)
+	if err != nil {
+		return qbchain.Acceptance{}, err
+	}
+	return qbchain.Acceptance{PublicKey: kp.Public, Origin: origin, Signature: sig}, nil
+}
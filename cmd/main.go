@@ -1,29 +1,167 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"os"
 
 	"github.com/spf13/viper"
 
 	".."
+	"../mempool"
+	"../reports"
 	// "github.intuit.com/payments/qbchain.git"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(audit())
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rebuild-index" {
+		os.Exit(rebuildIndex())
+	}
+
 	loadConfig()
 	db, _ := qbchain.MakeDB()
-	nodeID := strings.Replace(qbchain.PseudoUUID(), "-", "", -1)
+	keypair := loadNodeKeypair()
 	serverPort := viper.GetInt("api_port")
 	log.Printf("Starting QB Chain HTTP API Server. Listening at port %d", serverPort)
-	go qbchain.ListenUDP(viper.GetInt("udp_port"))
+	go qbchain.ListenPeers(viper.GetInt("p2p_port"), db)
+
+	peers := qbchain.NewPeerRegistry(db)
+	for _, peer := range viper.GetStringSlice("peers") {
+		if _, err := peers.Add(peer); err != nil {
+			log.Printf("Ignoring peer %q from config: %s", peer, err)
+		}
+	}
+	go peers.Run(qbchain.PEER_PROBE_INTERVAL)
+
+	syncer := qbchain.NewSyncer(db)
+	go syncer.Run(peers.Addresses, qbchain.SYNC_INTERVAL)
 
-	http.Handle("/", qbchain.NewHandler(nodeID, db))
+	consensus := startConsensus(db, keypair)
+
+	pool := mempool.New(db, configInt("mempool.max_size", qbchain.MEMPOOL_MAX_SIZE), configInt("mempool.max_account_size", qbchain.MEMPOOL_MAX_ACCOUNT_SIZE))
+	var producer *qbchain.Producer
+	if consensus == nil {
+		producer = qbchain.NewProducer(db, pool, peers, keypair, configInt("producer.max_block_size", qbchain.PRODUCER_MAX_BLOCK_SIZE))
+		interval := viper.GetDuration("producer.interval")
+		if interval == 0 {
+			interval = qbchain.PRODUCER_INTERVAL
+		}
+		go producer.Run(interval)
+	}
+
+	http.Handle("/", qbchain.NewHandler(keypair, db, syncer, peers, consensus, pool, producer))
+	http.Handle("/reports/", reports.NewHandler(db))
+	http.Handle("/mempool", mempool.NewHandler(pool))
 	http.ListenAndServe(fmt.Sprintf(":%d", serverPort), nil)
 }
 
+// audit checks the sender/receiver block pairs in the local store and prints
+// the report as JSON. It exits non-zero if any issue was found.
+func audit() int {
+	db, cleanup := qbchain.MakeDB()
+	defer cleanup()
+
+	report, err := qbchain.Audit(db)
+	if err != nil {
+		log.Printf("Failed to audit the chains: %s", err)
+		return 2
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// rebuildIndex writes the secondary indexes of the local store again from
+// its blocks. The node must be stopped.
+func rebuildIndex() int {
+	db, cleanup := qbchain.MakeDB()
+	defer cleanup()
+
+	n, err := qbchain.RebuildIndexes(db)
+	if err != nil {
+		log.Printf("Failed to rebuild the indexes: %s", err)
+		return 1
+	}
+	log.Printf("Rebuilt the indexes of %d blocks", n)
+	return 0
+}
+
+// startConsensus runs HoneyBadger BFT if it is enabled in the config. The
+// validator set in the config is only used on the first run, later runs use
+// the set stored with the changes made since.
+func startConsensus(db *qbchain.DB, keypair *qbchain.Keypair) *qbchain.Consensus {
+	if !viper.GetBool("consensus.enabled") {
+		return nil
+	}
+
+	var validators []qbchain.Validator
+	if err := viper.UnmarshalKey("consensus.validators", &validators); err != nil {
+		log.Fatalf("Invalid validators in config: %s", err)
+	}
+	set, err := qbchain.NewValidatorSet(validators)
+	if err != nil {
+		log.Fatalf("Invalid validators in config: %s", err)
+	}
+	id := uint64(viper.GetInt("consensus.validator_id"))
+	self, ok := set.Get(id)
+	if !ok {
+		log.Fatalf("Validator %d is not in the validator set", id)
+	}
+	if self.PublicKey != string(keypair.Public) {
+		log.Fatalf("Validator %d has key %s in the validator set, not the node key", id, self.PublicKey)
+	}
+	batchSize := configInt("consensus.batch_size", qbchain.CONSENSUS_BATCH_SIZE)
+
+	transport, err := qbchain.NewTCPTransport(id, self.Address, keypair)
+	if err != nil {
+		log.Fatalf("Failed to listen for validators: %s", err)
+	}
+	consensus := qbchain.NewConsensus(id, set, batchSize, transport, db, keypair)
+	go func() {
+		if err := consensus.Run(); err != nil {
+			log.Fatalf("Consensus stopped: %s", err)
+		}
+	}()
+	log.Printf("Running HoneyBadger BFT as validator %d of %d", id, len(set.Validators))
+	return consensus
+}
+
+// loadNodeKeypair reads the identity of the node from its key file, which is
+// created on the first boot. The key file is encrypted with the passphrase in
+// the QBCHAIN_NODE_PASSPHRASE environment variable.
+func loadNodeKeypair() *qbchain.Keypair {
+	path := viper.GetString("node_key")
+	if path == "" {
+		path = qbchain.NODE_KEY_FILE
+	}
+	keypair, err := qbchain.LoadNodeKeypair(path, os.Getenv(qbchain.NODE_PASSPHRASE_ENV))
+	if err != nil {
+		log.Fatalf("Failed to load the node key from %s: %s", path, err)
+	}
+	qbchain.SetNodeKeypair(keypair)
+	log.Printf("Node key %s", keypair.Public)
+	return keypair
+}
+
+// configInt returns the value of key, or def if it is not set.
+func configInt(key string, def int) int {
+	if v := viper.GetInt(key); v != 0 {
+		return v
+	}
+	return def
+}
+
 func loadConfig() {
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
@@ -0,0 +1,403 @@
+package qbchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anthdm/hbbft"
+)
+
+func init() {
+	// Transactions and validator proposals travel inside HoneyBadger messages
+	gob.Register(&Transaction{})
+	gob.Register(&ValidatorProposal{})
+}
+
+// Consensus orders transactions with HoneyBadger BFT among a set of
+// validators. Every validator turns the committed batches into blocks in the
+// same order, so their chains agree without any of them being trusted.
+//
+// Changes to the validator set are ordered in the batches like transactions.
+// A proposal committed before its epoch takes effect at the end of the epoch
+// before it, when every validator restarts the protocol with the new set.
+type Consensus struct {
+	id        uint64
+	hb        *hbbft.HoneyBadger
+	transport hbbft.Transport
+	db        *DB
+	keypair   *Keypair
+	batchSize int
+	set       *ValidatorSet
+
+	// epoch counts the epochs committed across changes of the set, base is
+	// the epoch the running HoneyBadger instance started at
+	epoch uint64
+	base  uint64
+
+	// pending holds what this validator submitted that is not committed
+	// yet, by hash, so that it is submitted again to a new instance
+	pending map[string]hbbft.Transaction
+
+	// guards everything above, hb is not safe for concurrent use
+	mu sync.Mutex
+}
+
+// NewConsensus creates the validator id of set, which signs the blocks it
+// forges with keypair. A set stored by an earlier run, which includes the
+// changes made since, takes precedence over set.
+func NewConsensus(id uint64, set *ValidatorSet, batchSize int, tr hbbft.Transport, db *DB, keypair *Keypair) *Consensus {
+	if stored, err := db.getValidatorSet([]byte(DB_VALIDATORS_NAMESPACE)); err == nil {
+		set = stored
+	} else if err := db.setValidatorSet(set, []byte(DB_VALIDATORS_NAMESPACE)); err != nil {
+		log.Printf("Failed to store the validator set: %v", err)
+	}
+
+	c := &Consensus{id: id, transport: tr, db: db, keypair: keypair, batchSize: batchSize, set: set, epoch: set.Epoch, base: set.Epoch,
+		pending: make(map[string]hbbft.Transaction)}
+	c.connect()
+	return c
+}
+
+// peerTransport is a transport that is told the address and key of every
+// validator, such as TCPTransport.
+type peerTransport interface {
+	AddPeer(id uint64, addr string, key []byte)
+	RemovePeer(id uint64)
+	peerIDs() []uint64
+}
+
+// connect points the transport at the validators of the set, dropping those
+// that left, and creates the HoneyBadger instance, unless this node is not
+// one of them. What this validator submitted to the previous instance and is
+// not committed yet is submitted to the new one.
+func (c *Consensus) connect() {
+	if t, ok := c.transport.(peerTransport); ok {
+		for _, id := range t.peerIDs() {
+			if _, ok := c.set.Get(id); !ok {
+				t.RemovePeer(id)
+			}
+		}
+		for _, v := range c.set.Validators {
+			t.AddPeer(v.ID, v.Address, []byte(v.PublicKey))
+		}
+	}
+
+	c.hb = nil
+	if _, ok := c.set.Get(c.id); !ok {
+		log.Printf("Node %d is not a validator from epoch %d", c.id, c.epoch)
+		return
+	}
+	c.hb = hbbft.NewHoneyBadger(hbbft.Config{
+		N:         len(c.set.Validators),
+		ID:        c.id,
+		Nodes:     c.set.IDs(),
+		BatchSize: c.batchSize,
+	})
+	for _, tx := range c.pending {
+		c.hb.AddTransaction(tx)
+	}
+}
+
+// Submit adds a verified transaction to the batch this validator proposes.
+func (c *Consensus) Submit(t Transaction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hb == nil {
+		return errors.New("this node is not a validator")
+	}
+	c.pending[string(t.Hash())] = &t
+	c.hb.AddTransaction(&t)
+	return nil
+}
+
+// Submitted tells whether the transaction with the given hash was submitted
+// by this validator and is not committed yet.
+func (c *Consensus) Submitted(hash []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.pending[string(hash)]
+	return ok
+}
+
+// Run starts the protocol and handles messages from the other validators
+// until the transport is closed. Committed batches are turned into blocks
+// every CONSENSUS_COMMIT_INTERVAL.
+func (c *Consensus) Run() error {
+	if err := c.start(); err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(CONSENSUS_COMMIT_INTERVAL) {
+			c.Commit()
+		}
+	}()
+
+	for rpc := range c.transport.Consume() {
+		if err := c.handle(rpc); err != nil {
+			log.Printf("Failed to handle consensus message from validator %d: %v", rpc.NodeID, err)
+		}
+	}
+	return nil
+}
+
+func (c *Consensus) start() error {
+	c.mu.Lock()
+	if c.hb == nil {
+		c.mu.Unlock()
+		return nil
+	}
+	err := c.hb.Start()
+	msgs := c.hb.Messages()
+	c.mu.Unlock()
+
+	c.send(msgs)
+	return err
+}
+
+func (c *Consensus) handle(rpc hbbft.RPC) error {
+	msg, ok := rpc.Payload.(hbbft.HBMessage)
+	if !ok {
+		return errors.New("not a HoneyBadger message")
+	}
+	acs, ok := msg.Payload.(*hbbft.ACSMessage)
+	if !ok {
+		return errors.New("not an ACS message")
+	}
+
+	c.mu.Lock()
+	if c.hb == nil {
+		c.mu.Unlock()
+		return nil
+	}
+	err := c.hb.HandleMessage(rpc.NodeID, msg.Epoch, acs)
+	msgs := c.hb.Messages()
+	c.mu.Unlock()
+
+	c.send(msgs)
+	return err
+}
+
+func (c *Consensus) send(msgs []hbbft.MessageTuple) {
+	for _, msg := range msgs {
+		if err := c.transport.SendMessage(c.id, msg.To, msg.Payload); err != nil {
+			log.Printf("Failed to send consensus message to validator %d: %v", msg.To, err)
+		}
+	}
+}
+
+// Commit turns the batches committed since the last call into blocks and
+// returns the number of transactions applied. Batches are applied by epoch
+// and the transactions of a batch by timestamp, then hash, so that every
+// validator forges the same blocks. The proposals of a batch are accepted
+// against the set of its epoch, and the set changes at the end of an epoch
+// when a proposal takes effect. The batches the previous instance committed
+// after that epoch are dropped by every validator, which submits what it
+// proposed in them again.
+func (c *Consensus) Commit() int {
+	c.mu.Lock()
+	if c.hb == nil {
+		c.mu.Unlock()
+		return 0
+	}
+	outputs := c.hb.Outputs()
+	base := c.base
+	c.mu.Unlock()
+
+	epochs := make([]uint64, 0, len(outputs))
+	for epoch := range outputs {
+		epochs = append(epochs, epoch)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+
+	applied := 0
+	for _, epoch := range epochs {
+		applied += c.apply(orderBatch(outputs[epoch]), base+epoch)
+
+		c.mu.Lock()
+		for _, tx := range outputs[epoch] {
+			delete(c.pending, string(tx.Hash()))
+		}
+		c.accept(batchProposals(outputs[epoch]), base+epoch)
+		c.epoch = base + epoch + 1
+		c.mu.Unlock()
+
+		if c.activateProposals() {
+			if err := c.start(); err != nil {
+				log.Printf("Failed to restart consensus: %v", err)
+			}
+			break
+		}
+	}
+	return applied
+}
+
+// accept stores the proposals committed in epoch that are valid against the
+// current set, for activateProposals. c.mu must be held.
+func (c *Consensus) accept(proposals []*ValidatorProposal, epoch uint64) {
+	for _, p := range proposals {
+		if err := p.Verify(c.set, epoch); err != nil {
+			log.Printf("Dropped %s proposal for validator %d committed in epoch %d: %v", p.Action, p.Validator.ID, epoch, err)
+			continue
+		}
+		if err := c.db.addProposal(p, []byte(DB_VALIDATORS_NAMESPACE)); err != nil {
+			log.Printf("Failed to store %s proposal for validator %d: %v", p.Action, p.Validator.ID, err)
+		}
+	}
+}
+
+// activateProposals applies the proposals whose epoch has been reached and
+// reports whether the validator set changed.
+func (c *Consensus) activateProposals() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ns := []byte(DB_VALIDATORS_NAMESPACE)
+	proposals, err := c.db.getProposals(ns)
+	if err != nil {
+		log.Printf("Failed to load validator proposals: %v", err)
+		return false
+	}
+
+	changed := false
+	for i := range proposals {
+		p := &proposals[i]
+		if p.Epoch > c.epoch {
+			break
+		}
+		// Earlier proposals may have changed the set since this one was accepted
+		if err := p.Verify(c.set, p.Epoch-1); err != nil {
+			log.Printf("Dropped %s proposal for validator %d: %v", p.Action, p.Validator.ID, err)
+		} else {
+			log.Printf("Validator %d: %s takes effect at epoch %d", p.Validator.ID, p.Action, c.epoch)
+			c.set = p.Apply(c.set)
+			changed = true
+		}
+		c.db.deleteProposal(p, ns)
+	}
+	if !changed {
+		return false
+	}
+
+	c.set.Epoch, c.base = c.epoch, c.epoch
+	if err := c.db.setValidatorSet(c.set, ns); err != nil {
+		log.Printf("Failed to store the validator set: %v", err)
+	}
+	c.connect()
+	return true
+}
+
+// Propose submits a proposal that changes the validator set at a later
+// epoch. It is stored once it is committed in a batch, see Commit.
+func (c *Consensus) Propose(p *ValidatorProposal) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hb == nil {
+		return errors.New("this node is not a validator")
+	}
+	if err := p.Verify(c.set, c.epoch); err != nil {
+		return err
+	}
+	c.pending[string(p.Hash())] = p
+	c.hb.AddTransaction(p)
+	return nil
+}
+
+// ConsensusStatus is the validator set and epoch as seen by a node.
+type ConsensusStatus struct {
+	ValidatorID uint64              `json:"validator_id"`
+	Validating  bool                `json:"validating"`
+	Epoch       uint64              `json:"epoch"`
+	Set         ValidatorSet        `json:"set"`
+	Pending     []ValidatorProposal `json:"pending"`
+}
+
+func (c *Consensus) Status() (*ConsensusStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending, err := c.db.getProposals([]byte(DB_VALIDATORS_NAMESPACE))
+	if err != nil {
+		return nil, err
+	}
+	return &ConsensusStatus{c.id, c.hb != nil, c.epoch, *c.set, pending}, nil
+}
+
+// orderBatch sorts a committed batch and drops the transactions that were
+// proposed by more than one validator.
+func orderBatch(batch []hbbft.Transaction) []Transaction {
+	txns := make([]Transaction, 0, len(batch))
+	seen := make(map[string]bool)
+	for _, tx := range batch {
+		t, ok := tx.(*Transaction)
+		if !ok || seen[string(t.Hash())] {
+			continue
+		}
+		seen[string(t.Hash())] = true
+		txns = append(txns, *t)
+	}
+
+	sort.Slice(txns, func(i, j int) bool {
+		if txns[i].Header.Timestamp != txns[j].Header.Timestamp {
+			return txns[i].Header.Timestamp < txns[j].Header.Timestamp
+		}
+		return bytes.Compare(txns[i].Hash(), txns[j].Hash()) < 0
+	})
+	return txns
+}
+
+// batchProposals returns the validator proposals of a committed batch by
+// hash, dropping those proposed by more than one validator.
+func batchProposals(batch []hbbft.Transaction) []*ValidatorProposal {
+	proposals := make([]*ValidatorProposal, 0)
+	seen := make(map[string]bool)
+	for _, tx := range batch {
+		p, ok := tx.(*ValidatorProposal)
+		if !ok || seen[string(p.Hash())] {
+			continue
+		}
+		seen[string(p.Hash())] = true
+		proposals = append(proposals, p)
+	}
+
+	sort.Slice(proposals, func(i, j int) bool {
+		return bytes.Compare(proposals[i].Hash(), proposals[j].Hash()) < 0
+	})
+	return proposals
+}
+
+// apply forges the transactions of a committed batch into one block per
+// sender, in order of the sender's key, and returns the number of
+// transactions forged. forgeBlock drops the transactions that no longer
+// apply to this validator's chains, e.g. because the same transaction was
+// committed in an earlier epoch.
+func (c *Consensus) apply(txns []Transaction, epoch uint64) int {
+	bySender := make(map[string][]Transaction)
+	for _, t := range txns {
+		bySender[string(t.Header.From)] = append(bySender[string(t.Header.From)], t)
+	}
+	senders := make([]string, 0, len(bySender))
+	for sender := range bySender {
+		senders = append(senders, sender)
+	}
+	sort.Strings(senders)
+
+	applied := 0
+	for _, sender := range senders {
+		block, _, err := forgeBlock(c.db, bySender[sender], c.keypair)
+		if err != nil {
+			log.Printf("Skipped the transactions of %s committed in epoch %d: %v", sender, epoch, err)
+			continue
+		}
+		applied += len(*block.TransactionSlice)
+	}
+	return applied
+}
@@ -0,0 +1,122 @@
+package qbchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anthdm/hbbft"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestInvoiceTransaction(t *testing.T, issuer *Keypair, buyer []byte) Transaction {
+	tx, err := NewInvoiceTransaction(issuer.Public, buyer, makeTestInvoice())
+	require.NoError(t, err)
+	tx.Header.Nonce = tx.GenerateNonce(TRANSACTION_POW)
+	tx.Signature = tx.Sign(issuer)
+	return tx
+}
+
+// makeTestValidatorSet creates a validator for every address, with IDs in
+// order from 0.
+func makeTestValidatorSet(t *testing.T, addrs []string) (*ValidatorSet, []*Keypair) {
+	validators := make([]Validator, len(addrs))
+	keys := make([]*Keypair, len(addrs))
+	for i, addr := range addrs {
+		keys[i] = GenerateNewKeypair()
+		validators[i] = Validator{uint64(i), string(keys[i].Public), addr}
+	}
+	set, err := NewValidatorSet(validators)
+	require.NoError(t, err)
+	return set, keys
+}
+
+func TestConsensusOrderBatch(t *testing.T) {
+	require := require.New(t)
+
+	a := NewTransaction(GenerateNewKeypair().Public, nil, 1, nil)
+	a.Header.Timestamp = 2000
+	b := NewTransaction(GenerateNewKeypair().Public, nil, 2, nil)
+	b.Header.Timestamp = 1000
+	dup := a
+
+	batch := orderBatch([]hbbft.Transaction{&a, &b, &dup})
+	require.Len(batch, 2)
+	require.Equal(b.Hash(), batch[0].Hash())
+	require.Equal(a.Hash(), batch[1].Hash())
+}
+
+func TestConsensusCommit(t *testing.T) {
+	require := require.New(t)
+
+	const n = 4
+	set, _ := makeTestValidatorSet(t, []string{"local0", "local1", "local2", "local3"})
+	transports := make([]hbbft.Transport, n)
+	validators := make([]*Consensus, n)
+	dbs := make([]*DB, n)
+	for i := range validators {
+		db, cleanup := makeDBTest(t)
+		defer cleanup()
+		dbs[i] = db
+		transports[i] = hbbft.NewLocalTransport(uint64(i))
+		validators[i] = NewConsensus(uint64(i), set, CONSENSUS_BATCH_SIZE, transports[i], db, GenerateNewKeypair())
+	}
+	for i := range transports {
+		for j := range transports {
+			if i != j {
+				transports[i].Connect(transports[j].Addr(), transports[j])
+			}
+		}
+	}
+
+	issuer := GenerateNewKeypair()
+	tx := makeTestInvoiceTransaction(t, issuer, GenerateNewKeypair().Public)
+	for _, c := range validators {
+		require.NoError(c.Submit(tx))
+		go c.Run()
+	}
+
+	// Every validator forges the same block
+	deadline := time.Now().Add(10 * time.Second)
+	for i, db := range dbs {
+		for len(NewBlockchain(string(issuer.Public), db).chain) == 0 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		chain := NewBlockchain(string(issuer.Public), db).chain
+		require.Len(chain, 1, "validator %d", i)
+		require.Equal(NewBlockchain(string(issuer.Public), dbs[0]).latest, chain[0].BlockHash)
+	}
+
+	// A transaction committed again is not applied twice
+	require.Equal(0, validators[0].apply([]Transaction{tx}, 1))
+}
+
+// The transactions of a sender committed in the same epoch are forged into
+// one block
+func TestConsensusApplyBatch(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	set, _ := makeTestValidatorSet(t, []string{"local0", "local1", "local2", "local3"})
+	c := NewConsensus(0, set, CONSENSUS_BATCH_SIZE, hbbft.NewLocalTransport(0), db, GenerateNewKeypair())
+
+	issuer := GenerateNewKeypair()
+	other := GenerateNewKeypair()
+	var txns []Transaction
+	for _, number := range []string{"INV-0001", "INV-0002"} {
+		inv := makeTestInvoice()
+		inv.Number = number
+		tx, err := NewInvoiceTransaction(issuer.Public, GenerateNewKeypair().Public, inv)
+		require.NoError(err)
+		tx.Header.Nonce = tx.GenerateNonce(TRANSACTION_POW)
+		tx.Signature = tx.Sign(issuer)
+		txns = append(txns, tx)
+	}
+	txns = append(txns, makeTestInvoiceTransaction(t, other, GenerateNewKeypair().Public))
+
+	require.Equal(3, c.apply(txns, 0))
+	chain := NewBlockchain(string(issuer.Public), db).chain
+	require.Len(chain, 1)
+	require.Len(*chain[0].TransactionSlice, 2)
+	require.Len(NewBlockchain(string(other.Public), db).chain, 1)
+}
@@ -1,13 +1,26 @@
 package qbchain
 
+import "time"
+
 const (
 	BLOCKCHAIN_PORT      = "9119"
 	MAX_NODE_CONNECTIONS = 400
 
 	NETWORK_KEY_SIZE = 80
 
-	TRANSACTION_HEADER_SIZE = NETWORK_KEY_SIZE /* from key */ + NETWORK_KEY_SIZE /* to key */ + 4 /* int32 timestamp */ + 32 /* sha256 payload hash */ + 4 /* int32 payload length */ + 4 /* int32 nonce */
-	BLOCK_HEADER_SIZE       = NETWORK_KEY_SIZE /* origin key */ + 4 /* int32 timestamp */ + 32 /* prev block hash */ + 32 /* merkel tree hash */ + 4                                      /* int32 nonce */
+	// Version of the canonical header encodings, see TransactionHeader.MarshalBinary.
+	// Version 0 is the legacy fixed size layout, still used to verify old hashes.
+	TRANSACTION_HEADER_VERSION = 1
+	BLOCK_HEADER_VERSION       = 3
+
+	// Block header version from which Merkle trees hash leaves and inner
+	// nodes apart and do not repeat the odd node of a level, see merkleLevels.
+	MERKLE_TREE_VERSION = 2
+
+	// Block header version from which sender blocks carry the key of the
+	// node that forged them, whose signature is then checked, see
+	// Block.VerifyBlock.
+	BLOCK_SIGNER_VERSION = 3
 
 	KEY_POW_COMPLEXITY = 0
 
@@ -21,6 +34,62 @@ const (
 
 	MESSAGE_TYPE_SIZE    = 1
 	MESSAGE_OPTIONS_SIZE = 4
+	MAX_MESSAGE_SIZE     = 16 << 20
+
+	MESSAGE_BLOCK = 1
+	MESSAGE_ACK   = 2
+	MESSAGE_NACK  = 3
+
+	MESSAGE_GET_HEADS  = 4
+	MESSAGE_HEADS      = 5
+	MESSAGE_GET_BLOCKS = 6
+	MESSAGE_BLOCKS     = 7
+
+	MESSAGE_PING = 8
+	MESSAGE_PONG = 9
+
+	PEER_TIMEOUT        = 10 * time.Second
+	REPLICATION_RETRIES = 5
+	SYNC_INTERVAL       = 30 * time.Second
+	SYNC_BATCH_SIZE     = 100
+	PEER_PROBE_INTERVAL = 15 * time.Second
+	PEER_MAX_BACKOFF    = 10 * time.Minute
+
+	CONSENSUS_BATCH_SIZE      = 100
+	CONSENSUS_COMMIT_INTERVAL = time.Second
+
+	TRANSPORT_QUEUE_SIZE  = 1024
+	TRANSPORT_MIN_BACKOFF = 100 * time.Millisecond
+	TRANSPORT_MAX_BACKOFF = 10 * time.Second
+
+	// Node key file, encrypted with the passphrase from the environment
+	NODE_KEY_FILE       = "node.key"
+	NODE_PASSPHRASE_ENV = "QBCHAIN_NODE_PASSPHRASE"
+	SCRYPT_N            = 1 << 15
+	SCRYPT_R            = 8
+	SCRYPT_P            = 1
+
+	// Bounds of the scrypt parameters accepted from a key file, so that a
+	// tampered file cannot make the node allocate or compute without limit
+	SCRYPT_MAX_N      = 1 << 20
+	SCRYPT_MAX_P      = 16
+	SCRYPT_MAX_MEMORY = 1 << 30
+
+	MEMPOOL_MAX_SIZE         = 10000
+	MEMPOOL_MAX_ACCOUNT_SIZE = 100
+	PRODUCER_INTERVAL        = time.Second
+	PRODUCER_MAX_BLOCK_SIZE  = 100
+
+	DB_NAMESPACE             = "qbchain"
+	DB_PENDING_NAMESPACE     = "qbchain_pending"
+	DB_FORKS_NAMESPACE       = "qbchain_forks"
+	DB_PEERS_NAMESPACE       = "qbchain_peers"
+	DB_VALIDATORS_NAMESPACE  = "qbchain_validators"
+	DB_SUBMISSIONS_NAMESPACE = "qbchain_submissions"
 
-	DB_NAMESPACE = "qbchain"
+	// Secondary indexes of the blocks in DB_NAMESPACE
+	DB_TRANSACTIONS_INDEX_NAMESPACE = "qbchain_index_transactions"
+	DB_COMPANIES_INDEX_NAMESPACE    = "qbchain_index_companies"
+	DB_PAIRS_INDEX_NAMESPACE        = "qbchain_index_pairs"
+	DB_TIMES_INDEX_NAMESPACE        = "qbchain_index_times"
 )
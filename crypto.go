@@ -4,6 +4,8 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"math/big"
 
 	"github.com/izqui/helpers"
@@ -26,6 +28,22 @@ func GenerateNewKeypair() *Keypair {
 	return &kp
 }
 
+// KeypairFromPrivate derives the public key of a base58 private key.
+func KeypairFromPrivate(private []byte) (*Keypair, error) {
+	d, err := base58.DecodeToBig(private)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+	curve := elliptic.P224()
+	if d.Sign() <= 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("invalid private key")
+	}
+	x, y := curve.ScalarBaseMult(d.Bytes())
+
+	public := base58.EncodeBig([]byte{}, bigJoin(KeySize, x, y))
+	return &Keypair{Public: public, Private: private}, nil
+}
+
 func (k *Keypair) Sign(hash []byte) ([]byte, error) {
 	d, err := base58.DecodeToBig(k.Private)
 	if err != nil {
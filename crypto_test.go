@@ -17,6 +17,23 @@ func TestGenerateNewKeypair(t *testing.T) {
 	}
 }
 
+func TestKeypairFromPrivate(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		keypair := GenerateNewKeypair()
+
+		derived, err := KeypairFromPrivate(keypair.Private)
+		if err != nil {
+			t.Error(err)
+		} else if string(derived.Public) != string(keypair.Public) {
+			t.Errorf("Derived public key %s, expected %s", derived.Public, keypair.Public)
+		}
+	}
+
+	if _, err := KeypairFromPrivate([]byte("0OIl")); err == nil {
+		t.Error("Invalid private key accepted")
+	}
+}
+
 func TestSignAndSignatureVerify(t *testing.T) {
 	for i := 0; i < 5; i++ {
 		keypair := GenerateNewKeypair()
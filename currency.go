@@ -0,0 +1,61 @@
+package qbchain
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// currencies maps the ISO 4217 codes accepted by the ledger to the number of
+// minor units (digits after the decimal point) of the currency. Amounts in
+// transactions and invoices are always expressed in minor units.
+var currencies = map[string]int{
+	"AUD": 2,
+	"BHD": 3,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"HKD": 2,
+	"INR": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"MXN": 2,
+	"SEK": 2,
+	"SGD": 2,
+	"USD": 2,
+}
+
+// MinorUnits returns the number of minor units of the currency.
+func MinorUnits(currency string) (int, bool) {
+	units, ok := currencies[currency]
+	return units, ok
+}
+
+func ValidCurrency(currency string) bool {
+	_, ok := currencies[currency]
+	return ok
+}
+
+// FormatAmount renders an amount in minor units as a decimal string, e.g.
+// 12345 USD is "123.45 USD" and 12345 JPY is "12345 JPY".
+func FormatAmount(amount int64, currency string) string {
+	units, ok := MinorUnits(currency)
+	if !ok || units == 0 {
+		return fmt.Sprintf("%d %s", amount, currency)
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	digits := strconv.FormatInt(amount, 10)
+	if len(digits) <= units {
+		digits = strings.Repeat("0", units-len(digits)+1) + digits
+	}
+	point := len(digits) - units
+	return fmt.Sprintf("%s%s.%s %s", sign, digits[:point], digits[point:], currency)
+}
@@ -0,0 +1,35 @@
+package qbchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatAmount(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal("123.45 USD", FormatAmount(12345, "USD"))
+	require.Equal("0.05 EUR", FormatAmount(5, "EUR"))
+	require.Equal("-1.00 EUR", FormatAmount(-100, "EUR"))
+	require.Equal("12345 JPY", FormatAmount(12345, "JPY"))
+	require.Equal("1.500 KWD", FormatAmount(1500, "KWD"))
+}
+
+func TestBlockchainBalancesPerCurrency(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	alice := GenerateNewKeypair().Public
+	bob := GenerateNewKeypair().Public
+	for i, currency := range []string{"USD", "JPY", "USD"} {
+		tx := NewTransaction(alice, bob, 100, nil)
+		tx.Header.Currency = currency
+		tx.Header.Timestamp = uint32(1000 + i)
+		forgeTestTransfer(db, tx, nil)
+	}
+
+	bc := NewBlockchain(string(alice), db)
+	require.Equal(map[string]int64{"USD": 200, "JPY": 100}, bc.balances)
+}
@@ -1,11 +1,13 @@
 package qbchain
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"path"
+	"strings"
 	"time"
 
 	badgerdb "github.com/dgraph-io/badger"
@@ -70,6 +72,13 @@ func (db *DB) Get(namespace, key []byte) (value []byte, err error) {
 	return value, nil
 }
 
+// Delete removes a key, it is not an error if the key does not exist
+func (db *DB) Delete(namespace, key []byte) error {
+	return db.badger.Update(func(txn *badgerdb.Txn) error {
+		return txn.Delete(badgerKey(namespace, key))
+	})
+}
+
 func badgerPrefix(namespace []byte) []byte {
 	return []byte(string(namespace) + "/")
 }
@@ -103,32 +112,43 @@ func (db *DB) runGC() {
 
 type ChainInfo struct {
 	CompanyID string
-	Balance   int64
+	Balances  map[string]int64
 	Latest    []byte
+	Height    int
 }
 
-func (db *DB) writeChainInfoToDB(bc *Blockchain, namespace []byte) {
+// setChainInfo updates the chain info of bc, the balances, latest block and
+// height of the account, in a badger transaction.
+func setChainInfo(txn *badgerdb.Txn, bc *Blockchain, namespace []byte) error {
 	var chainInfo ChainInfo
 
 	// write block to db if not the first dummy block
 	if len((*bc.chain.LastBlock().TransactionSlice)) > 0 {
 		t := (*bc.chain.LastBlock().TransactionSlice)[0]
-		key := t.Header.From
-		value, _ := db.Get(namespace, key)
-		data := ChainInfo{t.Header.CompanyID, bc.balance, bc.latest}
-		byteValue, _ := json.Marshal(data)
-		if value == nil {
+		key := badgerKey(namespace, t.Header.From)
+		item, err := txn.Get(key)
+		if err == badgerdb.ErrKeyNotFound {
 			log.Printf("create new chain info")
-			db.Set(namespace, key, byteValue)
-		} else {
-			json.Unmarshal(value, &chainInfo)
-			chainInfo.Balance = bc.balance
-			chainInfo.Latest = bc.latest
-			newValue, _ := json.Marshal(chainInfo)
-			log.Printf("update chain info")
-			db.Set(namespace, key, newValue)
+			data := ChainInfo{t.Header.CompanyID, bc.balances, bc.latest, len(bc.chain)}
+			byteValue, _ := json.Marshal(data)
+			return txn.Set(key, byteValue)
+		}
+		if err != nil {
+			return err
 		}
+		value, err := item.Value()
+		if err != nil {
+			return err
+		}
+		json.Unmarshal(value, &chainInfo)
+		chainInfo.Balances = bc.balances
+		chainInfo.Latest = bc.latest
+		chainInfo.Height = len(bc.chain)
+		newValue, _ := json.Marshal(chainInfo)
+		log.Printf("update chain info")
+		return txn.Set(key, newValue)
 	}
+	return nil
 }
 
 func (db *DB) getChainInfo(pk string, namespace []byte) (chainInfo ChainInfo, err error) {
@@ -154,19 +174,401 @@ func MakeDB() (*DB, func()) {
 	return db, cleanup
 }
 
-func (db *DB) addBlock(bc *Blockchain, namespace []byte) {
+// blockKey is the key of the block at the given height of an account chain.
+// Heights are zero padded so that the blocks of a chain are stored in order.
+func blockKey(pk []byte, height int) []byte {
+	return []byte(fmt.Sprintf("%s_%010d", pk, height))
+}
+
+// addBlock writes the latest block of a chain together with the
+// submissions of its transactions, its secondary indexes and the chain info,
+// in one badger transaction.
+func (db *DB) addBlock(bc *Blockchain, namespace []byte) error {
+	return db.updateBlock(bc, namespace, nil)
+}
+
+// addSenderBlock is addBlock for a block forged by this node, which holds
+// the receiver blocks mirroring it as pending in the same transaction.
+func (db *DB) addSenderBlock(bc *Blockchain, held []Block, namespace, pendingNamespace []byte) error {
+	return db.updateBlock(bc, namespace, func(txn *badgerdb.Txn) error {
+		for i := range held {
+			blockByte, err := json.Marshal(held[i])
+			if err != nil {
+				return err
+			}
+			key := pendingKey(string(held[i].Owner()), held[i].BlockHeader.Origin)
+			if err := txn.Set(badgerKey(pendingNamespace, key), blockByte); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// acceptPendingBlock is addBlock for a receiver block accepted by its owner,
+// which deletes the pending block in the same transaction. It fails if the
+// pending block is gone, e.g. because it is accepted already.
+func (db *DB) acceptPendingBlock(bc *Blockchain, namespace, pendingNamespace []byte) error {
+	Block := bc.chain.LastBlock()
+	key := badgerKey(pendingNamespace, pendingKey(string(Block.Owner()), Block.BlockHeader.Origin))
+	return db.updateBlock(bc, namespace, func(txn *badgerdb.Txn) error {
+		if _, err := txn.Get(key); err != nil {
+			return err
+		}
+		return txn.Delete(key)
+	})
+}
+
+// updateBlock writes the latest block of a chain as addBlock does, and runs
+// also, if not nil, in the same transaction.
+func (db *DB) updateBlock(bc *Blockchain, namespace []byte, also func(txn *badgerdb.Txn) error) error {
 	Block := *bc.chain.LastBlock()
 	// write block to db if not the first dummy block
 	if len(*bc.chain.LastBlock().TransactionSlice) > 0 {
-		t := (*bc.chain.LastBlock().TransactionSlice)[0]
-		pk := t.Header.From
-		timestamp := t.Header.Timestamp
-		// Use timestamp instead of txnId to retrieve in the correct order
-		key := string(pk) + "_" + fmt.Sprint(timestamp)
 		blockByte, _ := json.Marshal(Block)
-		db.Set(namespace, []byte(key), blockByte)
+		key := blockKey(Block.Owner(), len(bc.chain)-1)
+		err := db.badger.Update(func(txn *badgerdb.Txn) error {
+			if err := txn.Set(badgerKey(namespace, key), blockByte); err != nil {
+				return err
+			}
+			if err := indexBlock(txn, &Block, key); err != nil {
+				return err
+			}
+			if err := setChainInfo(txn, bc, namespace); err != nil {
+				return err
+			}
+			if also != nil {
+				return also(txn)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("could not add block: %v", err)
+			return err
+		}
 		log.Printf("new block added")
 	}
+	return nil
+}
+
+// Submissions are keyed by the sender and the TransactionID.
+func submissionKey(from []byte, transactionID string) []byte {
+	return []byte(string(from) + "_" + transactionID)
+}
+
+// setSubmissions records the transactions of a sender block that have a
+// TransactionID. Receiver blocks hold the transactions of other senders.
+func setSubmissions(txn *badgerdb.Txn, b *Block, key []byte, namespace []byte) error {
+	if b.IsMirror() {
+		return nil
+	}
+	for _, t := range *b.TransactionSlice {
+		if t.Header.TransactionID == "" {
+			continue
+		}
+		value, err := json.Marshal(Submission{t.Hash(), b.BlockHash, string(key)})
+		if err != nil {
+			return err
+		}
+		if err := txn.Set(badgerKey(namespace, submissionKey(t.Header.From, t.Header.TransactionID)), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSubmissions removes the submissions recorded by setSubmissions.
+func deleteSubmissions(txn *badgerdb.Txn, b *Block, namespace []byte) error {
+	if b.IsMirror() {
+		return nil
+	}
+	for _, t := range *b.TransactionSlice {
+		if t.Header.TransactionID == "" {
+			continue
+		}
+		if err := txn.Delete(badgerKey(namespace, submissionKey(t.Header.From, t.Header.TransactionID))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexKey joins the parts of a key of a secondary index. The parts are
+// terminated by a zero byte, so that a scan for a part does not match the
+// parts it is a prefix of.
+func indexKey(parts ...string) []byte {
+	return []byte(strings.Join(parts, "\x00") + "\x00")
+}
+
+// timeKey sorts the keys of the time index by timestamp.
+func timeKey(timestamp uint32) string {
+	return fmt.Sprintf("%010d", timestamp)
+}
+
+// indexEntry is a key of a secondary index and the value stored under it.
+type indexEntry struct {
+	namespace string
+	key       []byte
+	value     []byte
+}
+
+// indexEntries returns the secondary index entries of a block stored under
+// key. Every entry ends with the block key, so that removing the block only
+// removes its own entries.
+func indexEntries(b *Block, key []byte) []indexEntry {
+	k := string(key)
+	entry := func(namespace string, value string, parts ...string) indexEntry {
+		return indexEntry{namespace, indexKey(append(parts, k)...), []byte(value)}
+	}
+
+	owner := string(b.Owner())
+	var entries []indexEntry
+	for _, t := range b.AuthoredTransactions() {
+		if id := t.Header.TransactionID; id != "" {
+			entries = append(entries, entry(DB_TRANSACTIONS_INDEX_NAMESPACE, k, id))
+		}
+		// The company of a receiver block is the one of the sender
+		if cid := t.Header.CompanyID; cid != "" && !b.IsMirror() {
+			entries = append(entries, entry(DB_COMPANIES_INDEX_NAMESPACE, owner, cid, owner))
+		}
+		from, to := string(t.Header.From), string(t.Header.To)
+		if from > to {
+			from, to = to, from
+		}
+		entries = append(entries, entry(DB_PAIRS_INDEX_NAMESPACE, k, from, to))
+	}
+	return append(entries, entry(DB_TIMES_INDEX_NAMESPACE, k, timeKey(b.BlockHeader.Timestamp)))
+}
+
+// indexBlock writes the submissions and the secondary indexes of a block
+// stored under key.
+func indexBlock(txn *badgerdb.Txn, b *Block, key []byte) error {
+	if err := setSubmissions(txn, b, key, []byte(DB_SUBMISSIONS_NAMESPACE)); err != nil {
+		return err
+	}
+	for _, e := range indexEntries(b, key) {
+		if err := txn.Set(badgerKey([]byte(e.namespace), e.key), e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexBlock deletes the submissions and the secondary indexes of a block
+// stored under key, which is removed from its chain.
+func unindexBlock(txn *badgerdb.Txn, b *Block, key []byte) error {
+	if err := deleteSubmissions(txn, b, []byte(DB_SUBMISSIONS_NAMESPACE)); err != nil {
+		return err
+	}
+	for _, e := range indexEntries(b, key) {
+		if err := txn.Delete(badgerKey([]byte(e.namespace), e.key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceBlocks replaces the blocks of an account chain from height start
+// on with branch, along with their submissions and secondary indexes and
+// the chain info, in one badger transaction.
+func (db *DB) replaceBlocks(pk string, start int, removed, branch BlockSlice, info ChainInfo, namespace []byte) error {
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return db.badger.Update(func(txn *badgerdb.Txn) error {
+		for i := range removed {
+			key := blockKey([]byte(pk), start+i)
+			if err := txn.Delete(badgerKey(namespace, key)); err != nil {
+				return err
+			}
+			if err := unindexBlock(txn, &removed[i], key); err != nil {
+				return err
+			}
+		}
+		for i := range branch {
+			key := blockKey([]byte(pk), start+i)
+			blockBytes, err := json.Marshal(branch[i])
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(badgerKey(namespace, key), blockBytes); err != nil {
+				return err
+			}
+			if err := indexBlock(txn, &branch[i], key); err != nil {
+				return err
+			}
+		}
+		return txn.Set(badgerKey(namespace, []byte(pk)), infoBytes)
+	})
+}
+
+// reindexBlock writes the submissions and the secondary indexes of a block
+// already in the store.
+func (db *DB) reindexBlock(b *Block, key []byte) error {
+	return db.badger.Update(func(txn *badgerdb.Txn) error {
+		return indexBlock(txn, b, key)
+	})
+}
+
+// rekeyBlocks moves the blocks of every account chain that are not stored
+// under the key of their height, as older versions keyed blocks by the
+// timestamp of their first transaction. It returns the number of blocks
+// moved.
+func (db *DB) rekeyBlocks(namespace []byte) (int, error) {
+	var keys []string
+	err := db.badger.View(func(txn *badgerdb.Txn) error {
+		it := txn.NewIterator(badgerdb.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := badgerPrefix(namespace)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if key := string(it.Item().Key()[len(prefix):]); strings.Contains(key, "_") {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	heights := make(map[string]int)
+	for _, key := range keys {
+		pk := key[:strings.LastIndex(key, "_")]
+		height := heights[pk]
+		heights[pk]++
+		if newKey := string(blockKey([]byte(pk), height)); newKey != key {
+			err := db.badger.Update(func(txn *badgerdb.Txn) error {
+				item, err := txn.Get(badgerKey(namespace, []byte(key)))
+				if err != nil {
+					return err
+				}
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				if err := txn.Delete(badgerKey(namespace, []byte(key))); err != nil {
+					return err
+				}
+				return txn.Set(badgerKey(namespace, []byte(newKey)), value)
+			})
+			if err != nil {
+				return moved, err
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// scanIndex returns the values of the keys of an index that start with
+// prefix, in key order.
+func (db *DB) scanIndex(prefix []byte, namespace []byte) ([]string, error) {
+	var values []string
+	err := db.badger.View(func(txn *badgerdb.Txn) error {
+		it := txn.NewIterator(badgerdb.DefaultIteratorOptions)
+		defer it.Close()
+		p := badgerKey(namespace, prefix)
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			v, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			values = append(values, string(v))
+		}
+		return nil
+	})
+	return values, err
+}
+
+// scanTimeIndex returns the block keys of the time index with a timestamp
+// from from to to, both included, in timestamp order.
+func (db *DB) scanTimeIndex(from, to uint32, namespace []byte) ([]string, error) {
+	var keys []string
+	err := db.badger.View(func(txn *badgerdb.Txn) error {
+		it := txn.NewIterator(badgerdb.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := badgerPrefix(namespace)
+		last := timeKey(to)
+		for it.Seek(badgerKey(namespace, []byte(timeKey(from)))); it.ValidForPrefix(prefix); it.Next() {
+			if string(it.Item().Key()[len(prefix):len(prefix)+len(last)]) > last {
+				break
+			}
+			v, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			keys = append(keys, string(v))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// getBlocksByKeys reads blocks by the keys of a secondary index.
+func (db *DB) getBlocksByKeys(keys []string, namespace []byte) (BlockSlice, error) {
+	blocks := make(BlockSlice, 0, len(keys))
+	for _, key := range keys {
+		value, err := db.Get(namespace, []byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("indexed block %s: %v", key, err)
+		}
+		var block Block
+		if err := json.Unmarshal(value, &block); err != nil {
+			return nil, fmt.Errorf("indexed block %s: %v", key, err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// dropNamespace deletes every key of a namespace.
+func (db *DB) dropNamespace(namespace []byte) error {
+	var keys [][]byte
+	err := db.badger.View(func(txn *badgerdb.Txn) error {
+		it := txn.NewIterator(badgerdb.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := badgerPrefix(namespace)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deleted in batches to stay below the size limit of a transaction
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 1000 {
+			n = 1000
+		}
+		err := db.badger.Update(func(txn *badgerdb.Txn) error {
+			for _, k := range keys[:n] {
+				if err := txn.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func (db *DB) getSubmission(from []byte, transactionID string, namespace []byte) (s Submission, err error) {
+	value, err := db.Get(namespace, submissionKey(from, transactionID))
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(value, &s)
+	return s, err
 }
 
 func (db *DB) getBlocks(bc *Blockchain, pk string, namespace []byte) {
@@ -191,3 +593,267 @@ func (db *DB) getBlocks(bc *Blockchain, pk string, namespace []byte) {
 		panic(err)
 	}
 }
+
+// getAllBlocks returns the blocks of every account chain keyed by account.
+// Chain info is stored under the bare account key and is skipped.
+func (db *DB) getAllBlocks(namespace []byte) (map[string]BlockSlice, error) {
+	chains := make(map[string]BlockSlice)
+	err := db.badger.View(func(txn *badgerdb.Txn) error {
+		it := txn.NewIterator(badgerdb.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := badgerPrefix(namespace)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			key := string(item.Key()[len(prefix):])
+			sep := strings.LastIndex(key, "_")
+			if sep < 0 {
+				continue
+			}
+			v, err := item.Value()
+			if err != nil {
+				return err
+			}
+			var block Block
+			if err := json.Unmarshal(v, &block); err != nil {
+				return fmt.Errorf("block %s: %v", key, err)
+			}
+			pk := key[:sep]
+			chains[pk] = append(chains[pk], block)
+		}
+		return nil
+	})
+	return chains, err
+}
+
+// getChainInfos returns the chain info of every account keyed by account.
+func (db *DB) getChainInfos(namespace []byte) (map[string]ChainInfo, error) {
+	infos := make(map[string]ChainInfo)
+	err := db.badger.View(func(txn *badgerdb.Txn) error {
+		it := txn.NewIterator(badgerdb.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := badgerPrefix(namespace)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			key := string(item.Key()[len(prefix):])
+			if strings.Contains(key, "_") {
+				continue
+			}
+			v, err := item.Value()
+			if err != nil {
+				return err
+			}
+			var info ChainInfo
+			if err := json.Unmarshal(v, &info); err != nil {
+				return fmt.Errorf("chain info %s: %v", key, err)
+			}
+			infos[key] = info
+		}
+		return nil
+	})
+	return infos, err
+}
+
+// Pending receiver blocks are keyed by the receiver's key and the hash of the
+// sender's block they mirror.
+func pendingKey(pk string, origin []byte) []byte {
+	return []byte(pk + "_" + hex.EncodeToString(origin))
+}
+
+func (db *DB) addPendingBlock(pk string, b Block, namespace []byte) error {
+	blockByte, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	log.Printf("new pending block for: " + pk)
+	return db.Set(namespace, pendingKey(pk, b.BlockHeader.Origin), blockByte)
+}
+
+func (db *DB) getPendingBlock(pk string, origin []byte, namespace []byte) (block Block, err error) {
+	value, err := db.Get(namespace, pendingKey(pk, origin))
+	if err != nil {
+		return block, err
+	}
+	err = json.Unmarshal(value, &block)
+	return block, err
+}
+
+func (db *DB) getPendingBlocks(pk string, namespace []byte) ([]Block, error) {
+	blocks := make([]Block, 0)
+	err := db.badger.View(func(txn *badgerdb.Txn) error {
+		it := txn.NewIterator(badgerdb.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := badgerKey(namespace, []byte(pk+"_"))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			var block Block
+			if err := json.Unmarshal(v, &block); err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+		}
+		return nil
+	})
+	return blocks, err
+}
+
+func (db *DB) deletePendingBlock(pk string, origin []byte, namespace []byte) error {
+	return db.Delete(namespace, pendingKey(pk, origin))
+}
+
+// Quarantined forks are keyed by the account and the fork's ID.
+func forkKey(pk, id string) []byte {
+	return []byte(pk + "_" + id)
+}
+
+func (db *DB) setFork(f *Fork, namespace []byte) error {
+	forkByte, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return db.Set(namespace, forkKey(f.Account, f.ID), forkByte)
+}
+
+func (db *DB) getFork(pk, id string, namespace []byte) (fork Fork, err error) {
+	value, err := db.Get(namespace, forkKey(pk, id))
+	if err != nil {
+		return fork, err
+	}
+	err = json.Unmarshal(value, &fork)
+	return fork, err
+}
+
+// getForks returns the forks of an account, or of every account if pk is empty.
+func (db *DB) getForks(pk string, namespace []byte) ([]Fork, error) {
+	forks := make([]Fork, 0)
+	err := db.badger.View(func(txn *badgerdb.Txn) error {
+		it := txn.NewIterator(badgerdb.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := badgerPrefix(namespace)
+		if pk != "" {
+			prefix = badgerKey(namespace, []byte(pk+"_"))
+		}
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			var fork Fork
+			if err := json.Unmarshal(v, &fork); err != nil {
+				return err
+			}
+			forks = append(forks, fork)
+		}
+		return nil
+	})
+	return forks, err
+}
+
+func (db *DB) deleteFork(pk, id string, namespace []byte) error {
+	return db.Delete(namespace, forkKey(pk, id))
+}
+
+func (db *DB) setPeer(p *Peer, namespace []byte) error {
+	peerByte, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return db.Set(namespace, []byte(p.Address), peerByte)
+}
+
+func (db *DB) getPeer(address string, namespace []byte) (peer Peer, err error) {
+	value, err := db.Get(namespace, []byte(address))
+	if err != nil {
+		return peer, err
+	}
+	err = json.Unmarshal(value, &peer)
+	return peer, err
+}
+
+func (db *DB) getPeers(namespace []byte) ([]Peer, error) {
+	peers := make([]Peer, 0)
+	err := db.badger.View(func(txn *badgerdb.Txn) error {
+		it := txn.NewIterator(badgerdb.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := badgerPrefix(namespace)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			var peer Peer
+			if err := json.Unmarshal(v, &peer); err != nil {
+				return err
+			}
+			peers = append(peers, peer)
+		}
+		return nil
+	})
+	return peers, err
+}
+
+func (db *DB) deletePeer(address string, namespace []byte) error {
+	return db.Delete(namespace, []byte(address))
+}
+
+// The validator set and the proposals waiting for their epoch are kept in
+// the store, so changes survive restarts.
+var validatorSetKey = []byte("set")
+
+func (db *DB) getValidatorSet(namespace []byte) (*ValidatorSet, error) {
+	value, err := db.Get(namespace, validatorSetKey)
+	if err != nil {
+		return nil, err
+	}
+	set := new(ValidatorSet)
+	return set, json.Unmarshal(value, set)
+}
+
+func (db *DB) setValidatorSet(set *ValidatorSet, namespace []byte) error {
+	setByte, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+	return db.Set(namespace, validatorSetKey, setByte)
+}
+
+func proposalKey(p *ValidatorProposal) []byte {
+	return []byte(fmt.Sprintf("proposal_%020d_%s_%d", p.Epoch, p.Action, p.Validator.ID))
+}
+
+func (db *DB) addProposal(p *ValidatorProposal, namespace []byte) error {
+	proposalByte, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return db.Set(namespace, proposalKey(p), proposalByte)
+}
+
+func (db *DB) deleteProposal(p *ValidatorProposal, namespace []byte) error {
+	return db.Delete(namespace, proposalKey(p))
+}
+
+// getProposals returns the pending proposals in order of epoch.
+func (db *DB) getProposals(namespace []byte) ([]ValidatorProposal, error) {
+	proposals := make([]ValidatorProposal, 0)
+	err := db.badger.View(func(txn *badgerdb.Txn) error {
+		it := txn.NewIterator(badgerdb.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := badgerKey(namespace, []byte("proposal_"))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			var p ValidatorProposal
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			proposals = append(proposals, p)
+		}
+		return nil
+	})
+	return proposals, err
+}
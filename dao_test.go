@@ -64,3 +64,75 @@ func TestDaoSetAndGetforStruc(t *testing.T) {
 	require.NoError(err)
 	require.Equal(xByte, storedData)
 }
+
+func TestDaoPendingBlocks(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	ns := []byte(DB_PENDING_NAMESPACE)
+	block := NewBlock(nil)
+	block.BlockHeader.Origin = []byte("sender-block-hash")
+
+	require.NoError(db.addPendingBlock("receiver", block, ns))
+	blocks, err := db.getPendingBlocks("receiver", ns)
+	require.NoError(err)
+	require.Len(blocks, 1)
+
+	stored, err := db.getPendingBlock("receiver", block.BlockHeader.Origin, ns)
+	require.NoError(err)
+	require.Equal(block.BlockHeader.Origin, stored.BlockHeader.Origin)
+
+	require.NoError(db.deletePendingBlock("receiver", block.BlockHeader.Origin, ns))
+	blocks, err = db.getPendingBlocks("receiver", ns)
+	require.NoError(err)
+	require.Len(blocks, 0)
+}
+
+// Blocks are keyed by height, so blocks whose first transactions share a
+// second do not overwrite each other.
+func TestDaoBlocksInTheSameSecond(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	buyer := GenerateNewKeypair()
+	var held []Block
+	for _, issuer := range []*Keypair{GenerateNewKeypair(), GenerateNewKeypair()} {
+		for _, number := range []string{"INV-0001", "INV-0002"} {
+			inv := makeTestInvoice()
+			inv.Number = number
+			tx, err := NewInvoiceTransaction(issuer.Public, buyer.Public, inv)
+			require.NoError(err)
+			tx.Header.Timestamp = 1000
+			tx.Header.Nonce = tx.GenerateNonce(TRANSACTION_POW)
+			tx.Signature = tx.Sign(issuer)
+			_, rblocks, err := forgeBlock(db, []Transaction{tx}, GenerateNewKeypair())
+			require.NoError(err)
+			held = append(held, rblocks...)
+		}
+
+		chain := NewBlockchain(string(issuer.Public), db).chain
+		require.Len(chain, 2)
+		require.NoError(VerifyChain(chain))
+	}
+
+	// The receiver accepts the blocks of both senders in the same second
+	for _, rblock := range held {
+		bc := NewBlockchain(string(buyer.Public), db)
+		rblock.BlockHeader.PrevBlock = bc.latest
+		rblock.Signature, _ = buyer.Sign(rblock.BlockHeader.Origin)
+		rblock.BlockHash = rblock.Hash()
+		require.NoError(bc.acceptBlock(rblock, db))
+
+		// The pending block is gone, so it cannot be accepted twice
+		require.Error(NewBlockchain(string(buyer.Public), db).acceptBlock(rblock, db))
+	}
+	chain := NewBlockchain(string(buyer.Public), db).chain
+	require.Len(chain, 4)
+	require.NoError(VerifyChain(chain))
+	pending, err := db.getPendingBlocks(string(buyer.Public), []byte(DB_PENDING_NAMESPACE))
+	require.NoError(err)
+	require.Empty(pending)
+}
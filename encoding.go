@@ -0,0 +1,105 @@
+package qbchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// binaryWriter writes the canonical encoding of headers: fixed size integers
+// are little endian, byte slices and strings are prefixed by their length as
+// a little endian uint16. The first error is kept and returned by Bytes.
+type binaryWriter struct {
+	buf bytes.Buffer
+	err error
+}
+
+func (w *binaryWriter) uint8(v uint8) {
+	w.buf.WriteByte(v)
+}
+
+func (w *binaryWriter) uint32(v uint32) {
+	binary.Write(&w.buf, binary.LittleEndian, v)
+}
+
+func (w *binaryWriter) int64(v int64) {
+	binary.Write(&w.buf, binary.LittleEndian, v)
+}
+
+func (w *binaryWriter) bytes(b []byte) {
+	if len(b) > math.MaxUint16 {
+		if w.err == nil {
+			w.err = fmt.Errorf("field of %d bytes is too long to encode", len(b))
+		}
+		return
+	}
+	binary.Write(&w.buf, binary.LittleEndian, uint16(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *binaryWriter) string(s string) {
+	w.bytes([]byte(s))
+}
+
+func (w *binaryWriter) Bytes() ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// binaryReader reads what binaryWriter writes. The first error is kept and
+// returned by Err, later reads return zero values.
+type binaryReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *binaryReader) read(v interface{}) {
+	if r.err != nil {
+		return
+	}
+	if err := binary.Read(r.r, binary.LittleEndian, v); err != nil {
+		r.err = errors.New("unexpected end of header")
+	}
+}
+
+func (r *binaryReader) uint8() (v uint8) {
+	r.read(&v)
+	return v
+}
+
+func (r *binaryReader) uint32() (v uint32) {
+	r.read(&v)
+	return v
+}
+
+func (r *binaryReader) int64() (v int64) {
+	r.read(&v)
+	return v
+}
+
+func (r *binaryReader) bytes() []byte {
+	var l uint16
+	r.read(&l)
+	if r.err != nil || l == 0 {
+		return nil
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		r.err = errors.New("unexpected end of header")
+		return nil
+	}
+	return b
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *binaryReader) Err() error {
+	return r.err
+}
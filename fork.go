@@ -0,0 +1,235 @@
+package qbchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Fork is a branch of an account chain that conflicts with the local chain:
+// its first block has the same PrevBlock as a block we already hold. The
+// branch is kept in quarantine until it is resolved.
+type Fork struct {
+	ID         string     `json:"id"`
+	Account    string     `json:"account"`
+	ForkPoint  []byte     `json:"fork_point"`
+	Local      BlockSlice `json:"local"`
+	Branch     BlockSlice `json:"branch"`
+	DetectedAt time.Time  `json:"detected_at"`
+}
+
+// ForkError is returned for a block that was quarantined instead of being
+// added to its chain.
+type ForkError struct {
+	Account string
+	ID      string
+}
+
+func (e *ForkError) Error() string {
+	return fmt.Sprintf("block conflicts with the chain of %s, quarantined as fork %s", e.Account, e.ID)
+}
+
+// quarantine records a block that does not follow the latest block of its
+// chain, either as the start of a new fork or as the next block of a branch
+// that is already quarantined.
+//
+// The fork-choice rule only looks at the signatures of the account owner,
+// never at the length of either branch: a fully signed branch replaces a
+// local branch holding blocks the owner did not sign. If both branches are
+// signed the owner has equivocated and the fork is left for an operator to
+// resolve.
+func quarantine(db *DB, bc *Blockchain, pk string, b *Block) error {
+	ns := []byte(DB_FORKS_NAMESPACE)
+	forks, err := db.getForks(pk, ns)
+	if err != nil {
+		return err
+	}
+
+	var fork *Fork
+	for i := range forks {
+		for _, q := range forks[i].Branch {
+			if bytes.Equal(q.BlockHash, b.BlockHash) {
+				return &ForkError{pk, forks[i].ID}
+			}
+		}
+		if bytes.Equal(b.BlockHeader.PrevBlock, forks[i].Branch.LastBlock().BlockHash) {
+			fork = &forks[i]
+			fork.Branch = append(fork.Branch, *b)
+			break
+		}
+	}
+
+	if fork == nil {
+		start := -1
+		for i := range bc.chain {
+			if sameHash(bc.chain[i].BlockHeader.PrevBlock, b.BlockHeader.PrevBlock) {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			return fmt.Errorf("block does not follow the latest block %x of its chain", bc.latest)
+		}
+
+		fork = &Fork{
+			ID:         hex.EncodeToString(b.BlockHash),
+			Account:    pk,
+			ForkPoint:  b.BlockHeader.PrevBlock,
+			Local:      append(BlockSlice{}, bc.chain[start:]...),
+			Branch:     BlockSlice{*b},
+			DetectedAt: time.Now(),
+		}
+		log.Printf("Fork %s detected in the chain of %s at block %x", fork.ID, pk, fork.ForkPoint)
+	}
+
+	if !fork.Local.SignedBy([]byte(pk)) && fork.Branch.SignedBy([]byte(pk)) {
+		log.Printf("Fork %s is signed by the owner of %s, replacing unsigned blocks", fork.ID, pk)
+		_, err := resolveFork(db, fork, true)
+		return err
+	}
+
+	if err := db.setFork(fork, ns); err != nil {
+		return err
+	}
+	return &ForkError{pk, fork.ID}
+}
+
+// ResolveFork settles a quarantined fork. If keepBranch is false the branch
+// is discarded, otherwise the blocks of the local chain after the fork point
+// are replaced by the branch. It returns the blocks that were discarded.
+func ResolveFork(db *DB, pk, id string, keepBranch bool) (BlockSlice, error) {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	fork, err := db.getFork(pk, id, []byte(DB_FORKS_NAMESPACE))
+	if err != nil {
+		return nil, fmt.Errorf("fork %s not found in the chain of %s", id, pk)
+	}
+	return resolveFork(db, &fork, keepBranch)
+}
+
+func resolveFork(db *DB, fork *Fork, keepBranch bool) (BlockSlice, error) {
+	discarded := fork.Branch
+	if keepBranch {
+		var err error
+		if discarded, err = replaceBranch(db, fork.Account, fork.ForkPoint, fork.Branch); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Fork %s of %s resolved, %d blocks discarded", fork.ID, fork.Account, len(discarded))
+	db.deleteFork(fork.Account, fork.ID, []byte(DB_FORKS_NAMESPACE))
+	return discarded, nil
+}
+
+// replaceBranch replaces the blocks of an account chain after forkPoint with
+// branch and returns the blocks it removed. The chain is changed in a single
+// transaction, so that it is never left half replaced.
+func replaceBranch(db *DB, pk string, forkPoint []byte, branch BlockSlice) (BlockSlice, error) {
+	bc := NewBlockchain(pk, db)
+
+	start := -1
+	for i := range bc.chain {
+		if sameHash(bc.chain[i].BlockHeader.PrevBlock, forkPoint) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, errors.New("fork point is no longer in the chain")
+	}
+
+	removed := bc.chain[start:]
+	kept := append(append(BlockSlice{}, bc.chain[:start]...), branch...)
+	if err := verifyBranch(db, pk, kept, branch); err != nil {
+		return nil, fmt.Errorf("branch is not valid: %v", err)
+	}
+
+	info, _ := db.getChainInfo(pk, []byte(DB_NAMESPACE))
+	info.Balances = make(map[string]int64)
+	info.Latest = nil
+	for _, kept := range kept {
+		for _, tx := range *kept.TransactionSlice {
+			info.Balances[tx.Header.Currency] += tx.Header.Amount
+		}
+		info.Latest = kept.BlockHash
+	}
+	info.Height = start + len(branch)
+
+	if err := db.replaceBlocks(pk, start, removed, branch, info, []byte(DB_NAMESPACE)); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// verifyBranch checks the chain of pk as it would be with a branch in place
+// of its blocks after the fork point: the structure and signatures of every
+// block, that no transaction, TransactionID or sender block is in it twice,
+// and that the history of every invoice the branch touches still replays.
+// Quarantined blocks were never checked against the chain, so none of this
+// can be assumed.
+func verifyBranch(db *DB, pk string, kept, branch BlockSlice) error {
+	if err := VerifyAccountChain([]byte(pk), kept); err != nil {
+		return err
+	}
+
+	hashes := make(map[string]bool)
+	ids := make(map[string]bool)
+	origins := make(map[string]bool)
+	for i := range kept {
+		b := &kept[i]
+		if b.IsMirror() {
+			if origins[string(b.BlockHeader.Origin)] {
+				return fmt.Errorf("sender block %x is accepted twice", b.BlockHeader.Origin)
+			}
+			origins[string(b.BlockHeader.Origin)] = true
+		}
+		for _, t := range b.AuthoredTransactions() {
+			if hashes[string(t.Hash())] {
+				return fmt.Errorf("transaction %x is in the chain twice", t.Hash())
+			}
+			hashes[string(t.Hash())] = true
+			if id := t.Header.TransactionID; id != "" && !b.IsMirror() {
+				if ids[id] {
+					return &ConflictError{TransactionID: id}
+				}
+				ids[id] = true
+			}
+		}
+	}
+
+	chainOf := func(account string) *Blockchain {
+		if account == pk {
+			return &Blockchain{chain: kept}
+		}
+		return NewBlockchain(account, db)
+	}
+	replayed := make(map[string]bool)
+	for i := range branch {
+		for _, t := range branch[i].AuthoredTransactions() {
+			id := t.Header.Reference
+			if t.Header.Kind == KindInvoice {
+				if err := t.VerifyInvoice(); err != nil {
+					return err
+				}
+				id = t.Header.TransactionID
+			}
+			issuer := invoiceIssuer(&t)
+			if replayed[invoiceKey(issuer, id)] {
+				continue
+			}
+			replayed[invoiceKey(issuer, id)] = true
+
+			// The invoice may only be in the chain of the counterparty
+			if _, err := loadInvoiceStatus(chainOf, string(t.Header.From), string(issuer), id); err != nil {
+				if _, err := loadInvoiceStatus(chainOf, string(t.Header.To), string(issuer), id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
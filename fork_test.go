@@ -0,0 +1,135 @@
+package qbchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForkQuarantine(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	kp := GenerateNewKeypair()
+	pk := string(kp.Public)
+	first := makeTestSenderBlock(kp, nil, 1000)
+	require.NoError(storeReplicatedBlock(db, &first))
+	local := makeTestSenderBlock(kp, first.BlockHash, 1001)
+	require.NoError(storeReplicatedBlock(db, &local))
+
+	// Both branches are signed by the owner, so neither wins by itself,
+	// however long the conflicting branch grows
+	branch := makeTestSenderBlock(kp, first.BlockHash, 1002)
+	err := storeReplicatedBlock(db, &branch)
+	require.IsType(&ForkError{}, err)
+	id := err.(*ForkError).ID
+	next := makeTestSenderBlock(kp, branch.BlockHash, 1003)
+	require.IsType(&ForkError{}, storeReplicatedBlock(db, &next))
+	require.IsType(&ForkError{}, storeReplicatedBlock(db, &branch))
+
+	require.Equal(local.BlockHash, NewBlockchain(pk, db).latest)
+
+	forks, err := db.getForks(pk, []byte(DB_FORKS_NAMESPACE))
+	require.NoError(err)
+	require.Len(forks, 1)
+	require.Equal(id, forks[0].ID)
+	require.Equal(first.BlockHash, forks[0].ForkPoint)
+	require.Len(forks[0].Local, 1)
+	require.Len(forks[0].Branch, 2)
+
+	discarded, err := ResolveFork(db, pk, id, true)
+	require.NoError(err)
+	require.Len(discarded, 1)
+	require.Equal(local.BlockHash, discarded[0].BlockHash)
+
+	bc := NewBlockchain(pk, db)
+	require.Len(bc.chain, 3)
+	require.Equal(next.BlockHash, bc.latest)
+	require.Equal(3*(*first.TransactionSlice)[0].Header.Amount, bc.balances["USD"])
+	require.Equal(first.BlockHash, bc.chain[1].BlockHeader.PrevBlock)
+
+	// The indexes and submissions follow the replaced blocks
+	found, err := FindTransactions(db, "INV-1001")
+	require.NoError(err)
+	require.Empty(found)
+	found, err = FindTransactions(db, "INV-1003")
+	require.NoError(err)
+	require.Len(found, 1)
+	require.Equal(next.BlockHash, found[0].Block)
+	blocks, err := BlocksInRange(db, 1000, 1003)
+	require.NoError(err)
+	require.Len(blocks, 3)
+	forged, err := findSubmission(db, &(*local.TransactionSlice)[0])
+	require.NoError(err)
+	require.Nil(forged)
+
+	_, err = ResolveFork(db, pk, id, false)
+	require.Error(err)
+}
+
+// A quarantined branch is checked against the chain before it is kept
+func TestForkResolveInvalidBranch(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	kp := GenerateNewKeypair()
+	pk := string(kp.Public)
+	first := makeTestSenderBlock(kp, nil, 1000)
+	require.NoError(storeReplicatedBlock(db, &first))
+	local := makeTestSenderBlock(kp, first.BlockHash, 1001)
+	require.NoError(storeReplicatedBlock(db, &local))
+
+	// Another invoice with the number of the first one
+	reused := makeTestInvoice()
+	reused.Number = "INV-1000"
+	tx, err := NewInvoiceTransaction(kp.Public, GenerateNewKeypair().Public, reused)
+	require.NoError(err)
+	tx.Header.Timestamp = 1002
+	tx.Header.Nonce = tx.GenerateNonce(TRANSACTION_POW)
+	tx.Signature = tx.Sign(kp)
+	branch := makeTestBlock(first.BlockHash, tx)
+	err = storeReplicatedBlock(db, &branch)
+	require.IsType(&ForkError{}, err)
+	id := err.(*ForkError).ID
+
+	_, err = ResolveFork(db, pk, id, true)
+	require.Error(err)
+	require.Equal(local.BlockHash, NewBlockchain(pk, db).latest)
+
+	// Nor can it break the chain it replaces a part of
+	unlinked := makeTestSenderBlock(kp, first.BlockHash, 1003)
+	err = storeReplicatedBlock(db, &unlinked)
+	require.IsType(&ForkError{}, err)
+	fork, err := db.getFork(pk, err.(*ForkError).ID, []byte(DB_FORKS_NAMESPACE))
+	require.NoError(err)
+	_, err = replaceBranch(db, pk, fork.ForkPoint, BlockSlice{local, unlinked})
+	require.Error(err)
+	require.Equal(local.BlockHash, NewBlockchain(pk, db).latest)
+}
+
+func TestForkChoiceUnsignedLocal(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	kp := GenerateNewKeypair()
+	pk := string(kp.Public)
+	first := makeTestSenderBlock(kp, nil, 1000)
+	require.NoError(storeReplicatedBlock(db, &first))
+
+	// A block the owner did not sign, e.g. written before signatures were checked
+	unsigned := makeTestSenderBlock(kp, first.BlockHash, 1001)
+	(*unsigned.TransactionSlice)[0].Signature = nil
+	bc := NewBlockchain(pk, db)
+	require.NoError(bc.AddBlock(unsigned, db))
+
+	branch := makeTestSenderBlock(kp, first.BlockHash, 1002)
+	require.NoError(storeReplicatedBlock(db, &branch))
+	require.Equal(branch.BlockHash, NewBlockchain(pk, db).latest)
+
+	forks, err := db.getForks(pk, []byte(DB_FORKS_NAMESPACE))
+	require.NoError(err)
+	require.Empty(forks)
+}
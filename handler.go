@@ -9,25 +9,42 @@ import (
 	"time"
 
 	"github.com/izqui/helpers"
-	"github.com/spf13/viper"
 )
 
-func NewHandler(nodeID string, db *DB) http.Handler {
-	h := handler{nil, nodeID, db}
+func NewHandler(keypair *Keypair, db *DB, syncer *Syncer, peers *PeerRegistry, consensus *Consensus, pool Mempool, producer *Producer) http.Handler {
+	h := handler{nil, keypair, db, syncer, peers, consensus, pool, producer}
 
 	mux := http.NewServeMux()
+	mux.HandleFunc("/node/info", buildResponse(h.NodeInfo))
+	mux.HandleFunc("/nodes", buildResponse(h.Nodes))
 	mux.HandleFunc("/nodes/register", buildResponse(h.RegisterNode))
 	mux.HandleFunc("/nodes/resolve", buildResponse(h.ResolveConflicts))
+	mux.HandleFunc("/transactions", buildResponse(h.Transactions))
 	mux.HandleFunc("/transactions/new", buildResponse(h.AddTransaction))
+	mux.HandleFunc("/transactions/pending", buildResponse(h.PendingTransactions))
+	mux.HandleFunc("/transactions/accept", buildResponse(h.AcceptTransaction))
 	mux.HandleFunc("/mine", buildResponse(h.Mine))
 	mux.HandleFunc("/chain", buildResponse(h.Blockchain))
+	mux.HandleFunc("/invoices/state", buildResponse(h.InvoiceState))
+	mux.HandleFunc("/audit", buildResponse(h.Audit))
+	mux.HandleFunc("/proof", buildResponse(h.Proof))
+	mux.HandleFunc("/sync/status", buildResponse(h.SyncStatus))
+	mux.HandleFunc("/forks", buildResponse(h.Forks))
+	mux.HandleFunc("/forks/resolve", buildResponse(h.ResolveFork))
+	mux.HandleFunc("/validators", buildResponse(h.Validators))
+	mux.HandleFunc("/validators/proposals", buildResponse(h.ProposeValidator))
 	return mux
 }
 
 type handler struct {
 	blockchain *Blockchain
-	nodeID     string
+	keypair    *Keypair
 	db         *DB
+	syncer     *Syncer
+	peers      *PeerRegistry
+	consensus  *Consensus
+	pool       Mempool
+	producer   *Producer
 }
 
 type response struct {
@@ -71,51 +88,82 @@ func (h *handler) AddTransaction(w io.Writer, r *http.Request) response {
 		status = http.StatusInternalServerError
 		log.Printf("there was an error when trying to add a transaction %v\n", err)
 		err = fmt.Errorf("fail to add transaction to the blockchain")
+	} else if forged, sErr := findSubmission(h.db, &t); sErr != nil {
+		// Checked before the header is changed below, on the hash the
+		// sender signed
+		status = http.StatusBadRequest
+		if _, ok := sErr.(*ConflictError); ok {
+			status = http.StatusConflict
+		}
+		err = sErr
+	} else if forged != nil {
+		// A retry of a transaction that was already forged
+		status = http.StatusOK
+		resp = map[string]interface{}{"message": "Transaction already forged", "block": forged}
+	} else if h.consensus != nil && h.consensus.Submitted(t.Hash()) {
+		// A retry of a transaction that is still being ordered, with the
+		// timestamp it was signed and submitted with
+		status = http.StatusAccepted
+		resp = map[string]interface{}{"message": "Transaction already submitted for ordering", "transaction": t}
+	} else if h.consensus == nil && h.pool != nil && h.pool.Has(t.Hash()) {
+		// A retry of a transaction that is still in the mempool
+		status = http.StatusAccepted
+		resp = map[string]interface{}{"message": "Transaction already in the mempool", "transaction": t}
 	} else {
 		t.Header.Timestamp = uint32(time.Now().Unix())
 		t.Header.PayloadHash = helpers.SHA256(t.Payload)
 		t.Header.PayloadLength = uint32(len(t.Payload))
 
-		// get blockchain based on pk
-		h.blockchain = NewBlockchain(string(t.Header.From), h.db)
-
-		if t.VerifyTransaction(TRANSACTION_POW) {
-			block := NewBlock(h.blockchain.latest)
-			block.AddTransaction(&t)
-			// Hack here, in fact miner should sign the block and add it to chain
-			block.BlockHeader.Nonce = t.Header.Nonce
-			block.Signature = t.Signature
-			block.BlockHeader.Timestamp = t.Header.Timestamp
-			block.BlockHash = block.Hash()
-
-			// Forge the new Block by adding it to the chain
-			h.blockchain.AddBlock(block, h.db)
-
-			// receiver txn
-			rTxn := t
-			rTxn.Header.To = t.Header.From
-			rTxn.Header.From = t.Header.To
-			rTxn.Header.Amount = -t.Header.Amount
-			// Write the transacton to the receiver's chain without verification
-			rBlockchain := NewBlockchain(string(rTxn.Header.From), h.db)
-			rblock := NewBlock(rBlockchain.latest)
-			rblock.AddTransaction(&rTxn)
-			rblock.BlockHeader.Nonce = rTxn.Header.Nonce
-			rblock.Signature = rTxn.Signature
-			rblock.BlockHeader.Timestamp = rTxn.Header.Timestamp
-			rblock.BlockHeader.Origin = block.BlockHash
-			rblock.BlockHash = rblock.Hash()
-
-			// Forge the new Block by adding it to the receiver's chain
-			rBlockchain.AddBlock(rblock, h.db)
-
-			// forward the new block to other nodes
-			sendToPeers(rblock)
-			resp = map[string]interface{}{"message": "New Block Forged", "block": block, "reveiverBlock": rblock}
-		} else {
+		if t.Header.Version != TRANSACTION_HEADER_VERSION {
+			status = http.StatusBadRequest
+			log.Printf("Unsupported transaction header version %d", t.Header.Version)
+			err = fmt.Errorf("Unsupported transaction header version %d, transactions must be signed with version %d", t.Header.Version, TRANSACTION_HEADER_VERSION)
+		} else if !t.VerifyTransaction(TRANSACTION_POW) {
 			status = http.StatusBadRequest
 			log.Printf("Invalid transaction")
 			err = fmt.Errorf("Invalid transaction")
+		} else if lcErr := VerifyLifecycle(h.db, &t); lcErr != nil {
+			status = http.StatusBadRequest
+			log.Printf("Rejected %s transaction: %v", t.Header.Kind, lcErr)
+			err = fmt.Errorf("Rejected %s transaction: %v", t.Header.Kind, lcErr)
+		} else if h.consensus != nil {
+			// The validators agree on the order of transactions before
+			// any of them forges a block
+			if cErr := h.consensus.Submit(t); cErr != nil {
+				status = http.StatusServiceUnavailable
+				err = fmt.Errorf("Cannot order transaction: %v", cErr)
+			} else {
+				status = http.StatusAccepted
+				resp = map[string]interface{}{"message": "Transaction submitted for ordering", "transaction": t}
+			}
+		} else if h.pool != nil {
+			// The producer batches the transactions of the mempool into blocks
+			pErr := h.pool.Add(t)
+			_, conflict := pErr.(*ConflictError)
+			if pErr == ErrMempoolFull {
+				status = http.StatusServiceUnavailable
+				err = pErr
+			} else if pErr == ErrAlreadyPending {
+				status = http.StatusAccepted
+				resp = map[string]interface{}{"message": "Transaction already in the mempool", "transaction": t}
+			} else if conflict {
+				status = http.StatusConflict
+				err = pErr
+			} else if pErr != nil {
+				status = http.StatusBadRequest
+				log.Printf("Rejected transaction: %v", pErr)
+				err = fmt.Errorf("Rejected transaction: %v", pErr)
+			} else {
+				status = http.StatusAccepted
+				resp = map[string]interface{}{"message": "Transaction added to the mempool", "transaction": t}
+			}
+		} else if block, rblocks, fErr := forgeBlock(h.db, []Transaction{t}, h.keypair); fErr != nil {
+			status = http.StatusBadRequest
+			err = fmt.Errorf("Rejected transaction: %v", fErr)
+		} else {
+			h.sendToPeers(block)
+
+			resp = map[string]interface{}{"message": "New Block Forged", "block": block, "pendingReceiverBlock": rblocks[0]}
 		}
 
 	}
@@ -123,22 +171,38 @@ func (h *handler) AddTransaction(w io.Writer, r *http.Request) response {
 	return response{resp, status, err}
 }
 
-func sendToPeers(b Block) {
-	peers := viper.GetStringSlice("peer_udp_ports")
-	for _, peer := range peers {
-		fmt.Println(peer)
-		// forward the new block to other nodes
-		payload, err := b.MarshalBinary()
-		if err != nil {
-			fmt.Println("Failed to marshal the block to binary")
-		} else {
-			SendUDP(payload, peer)
+func (h *handler) PendingTransactions(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
 		}
 	}
+	log.Println("Pending transactions requested")
+
+	pk := r.URL.Query().Get("pk")
+
+	blocks, err := h.db.getPendingBlocks(pk, []byte(DB_PENDING_NAMESPACE))
+	if err != nil {
+		log.Printf("there was an error when trying to get pending blocks %v\n", err)
+		return response{nil, http.StatusInternalServerError, fmt.Errorf("fail to get pending transactions")}
+	}
+
+	resp := map[string]interface{}{"pending": blocks, "length": len(blocks)}
+	return response{resp, http.StatusOK, nil}
 }
 
-func (h *handler) Mine(w io.Writer, r *http.Request) response {
-	if r.Method != http.MethodGet {
+// Acceptance is the receiver's counter-signature over the hash of the
+// sender's block, which is the Origin of the pending receiver block.
+type Acceptance struct {
+	PublicKey []byte `json:"public_key"`
+	Origin    []byte `json:"origin"`
+	Signature []byte `json:"signature"`
+}
+
+func (h *handler) AcceptTransaction(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodPost {
 		return response{
 			nil,
 			http.StatusMethodNotAllowed,
@@ -146,28 +210,80 @@ func (h *handler) Mine(w io.Writer, r *http.Request) response {
 		}
 	}
 
-	log.Println("Mining some coins")
+	log.Printf("Accepting pending transaction...\n")
+
+	var a Acceptance
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		log.Printf("there was an error when trying to accept a transaction %v\n", err)
+		return response{nil, http.StatusBadRequest, fmt.Errorf("fail to accept transaction")}
+	}
+
+	pk := string(a.PublicKey)
+	ns := []byte(DB_PENDING_NAMESPACE)
+	if !SignatureVerify(a.PublicKey, a.Signature, a.Origin) {
+		log.Printf("Invalid acceptance signature")
+		return response{nil, http.StatusBadRequest, fmt.Errorf("Invalid acceptance signature")}
+	}
+
+	// The receiver chain is extended under the lock that forging and
+	// replication hold, so that a concurrent block cannot fork it
+	replicationMu.Lock()
+	rblock, err := h.db.getPendingBlock(pk, a.Origin, ns)
+	if err != nil {
+		replicationMu.Unlock()
+		return response{nil, http.StatusNotFound, fmt.Errorf("no pending transaction for this key and origin")}
+	}
 
-	// We run the proof of work algorithm to get the next proof...
-	// lastBlock := h.blockchain.LastBlock()
-	// lastProof := lastBlock.Proof
-	// proof := h.blockchain.ProofOfWork(lastProof)
+	rBlockchain := NewBlockchain(pk, h.db)
+	rblock.BlockHeader.PrevBlock = rBlockchain.latest
+	rblock.Signature = a.Signature
+	rblock.BlockHash = rblock.Hash()
 
-	// We must receive a reward for finding the proof.
-	// The sender is "0" to signify that this node has mined a new coin.
-	newTx := NewTransaction(make([]byte, 0), []byte(h.nodeID), 1, []byte("Mine"))
-	prevBlock := h.blockchain.LastBlock()
-	block := NewBlock(prevBlock.Hash())
-	block.AddTransaction(&newTx)
+	// Forge the new Block by adding it to the receiver's chain
+	// The pending block is deleted along with it, so that it is only
+	// accepted once
+	err = rBlockchain.acceptBlock(rblock, h.db)
+	replicationMu.Unlock()
+	if err != nil {
+		log.Printf("could not add the accepted block: %v", err)
+		return response{nil, http.StatusInternalServerError, fmt.Errorf("fail to accept transaction")}
+	}
 
-	block.BlockHeader.Nonce = newTx.Header.Nonce
-	block.Signature = newTx.Signature
-	block.BlockHeader.Timestamp = newTx.Header.Timestamp
+	// forward the new block to other nodes
+	h.sendToPeers(rblock)
 
-	// Forge the new Block by adding it to the chain
-	h.blockchain.AddBlock(block, h.db)
+	resp := map[string]interface{}{"message": "New Block Forged", "block": rblock}
+	return response{resp, http.StatusCreated, nil}
+}
 
-	resp := map[string]interface{}{"message": "New Block Forged", "block": block}
+func (h *handler) sendToPeers(b Block) {
+	sendToPeers(h.peers, b)
+}
+
+func sendToPeers(peers *PeerRegistry, b Block) {
+	for _, peer := range peers.Addresses() {
+		// forward the new block to other nodes
+		go replicate(peer, b)
+	}
+}
+
+func (h *handler) Mine(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
+		}
+	}
+
+	log.Println("Forging the transactions of the mempool")
+
+	if h.producer == nil {
+		return response{nil, http.StatusNotFound, fmt.Errorf("block producer is not running on this node")}
+	}
+	blocks := h.producer.Produce()
+
+	resp := map[string]interface{}{"message": fmt.Sprintf("%d blocks forged", len(blocks)), "blocks": blocks}
 	return response{resp, http.StatusOK, nil}
 }
 
@@ -185,10 +301,96 @@ func (h *handler) Blockchain(w io.Writer, r *http.Request) response {
 
 	h.blockchain = NewBlockchain(pk, h.db)
 
-	resp := map[string]interface{}{"chain": h.blockchain.chain, "length": len(h.blockchain.chain), "balance": h.blockchain.balance}
+	resp := map[string]interface{}{"chain": h.blockchain.chain, "length": len(h.blockchain.chain), "balances": h.blockchain.balances}
 	return response{resp, http.StatusOK, nil}
 }
 
+func (h *handler) Transactions(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
+		}
+	}
+	log.Println("Transaction lookup requested")
+
+	id := r.URL.Query().Get("id")
+
+	found, err := FindTransactions(h.db, id)
+	if err != nil {
+		log.Printf("there was an error when trying to look up a transaction %v\n", err)
+		return response{nil, http.StatusInternalServerError, fmt.Errorf("fail to look up transaction %s", id)}
+	}
+	if len(found) == 0 {
+		return response{nil, http.StatusNotFound, fmt.Errorf("transaction %s not found", id)}
+	}
+
+	return response{found, http.StatusOK, nil}
+}
+
+func (h *handler) InvoiceState(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
+		}
+	}
+	log.Println("Invoice state requested")
+
+	pk := r.URL.Query().Get("pk")
+	id := r.URL.Query().Get("id")
+	issuer := r.URL.Query().Get("issuer")
+
+	status, err := LoadInvoiceStatus(h.db, pk, issuer, id)
+	if err != nil {
+		return response{nil, http.StatusNotFound, err}
+	}
+
+	return response{status, http.StatusOK, nil}
+}
+
+func (h *handler) Proof(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
+		}
+	}
+	log.Println("Inclusion proof requested")
+
+	pk := r.URL.Query().Get("pk")
+	id := r.URL.Query().Get("id")
+
+	proof, err := NewInclusionProof(NewBlockchain(pk, h.db), pk, id)
+	if err != nil {
+		return response{nil, http.StatusNotFound, err}
+	}
+
+	return response{proof, http.StatusOK, nil}
+}
+
+func (h *handler) Audit(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
+		}
+	}
+	log.Println("Audit requested")
+
+	report, err := Audit(h.db)
+	if err != nil {
+		log.Printf("there was an error when trying to audit the chains %v\n", err)
+		return response{nil, http.StatusInternalServerError, fmt.Errorf("fail to audit the chains")}
+	}
+
+	return response{report, http.StatusOK, nil}
+}
+
 func (h *handler) RegisterNode(w io.Writer, r *http.Request) response {
 	if r.Method != http.MethodPost {
 		return response{
@@ -201,25 +403,78 @@ func (h *handler) RegisterNode(w io.Writer, r *http.Request) response {
 	log.Println("Adding node to the blockchain")
 
 	var body map[string][]string
-	err := json.NewDecoder(r.Body).Decode(&body)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return response{nil, http.StatusBadRequest, fmt.Errorf("invalid list of nodes: %v", err)}
+	}
 
 	for _, node := range body["nodes"] {
-		h.blockchain.RegisterNode(node)
+		if _, err := h.peers.Add(node); err != nil {
+			return response{nil, http.StatusBadRequest, fmt.Errorf("invalid node address %q: %v", node, err)}
+		}
+	}
+
+	peers, err := h.peers.List()
+	if err != nil {
+		log.Printf("there was an error when trying to register a new node %v\n", err)
+		return response{nil, http.StatusInternalServerError, fmt.Errorf("fail to register nodes")}
 	}
 
 	resp := map[string]interface{}{
 		"message": "New nodes have been added",
-		"nodes":   h.blockchain.nodes.Keys(),
+		"nodes":   peers,
 	}
+	return response{resp, http.StatusCreated, nil}
+}
 
-	status := http.StatusCreated
+// NodeInfo is how a node identifies itself to clients.
+type NodeInfo struct {
+	PublicKey string `json:"public_key"`
+	Producer  bool   `json:"producer"`
+	Validator bool   `json:"validator"`
+}
+
+func (h *handler) NodeInfo(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
+		}
+	}
+	log.Println("Node info requested")
+
+	info := NodeInfo{string(h.keypair.Public), h.producer != nil, h.consensus != nil}
+	return response{info, http.StatusOK, nil}
+}
+
+// Nodes lists the registered peers, or removes the one given by ?address=
+// on DELETE.
+func (h *handler) Nodes(w io.Writer, r *http.Request) response {
+	switch r.Method {
+	case http.MethodGet:
+		log.Println("Nodes requested")
+	case http.MethodDelete:
+		address := r.URL.Query().Get("address")
+		log.Printf("Removing node %s", address)
+		if err := h.peers.Remove(address); err != nil {
+			return response{nil, http.StatusNotFound, err}
+		}
+	default:
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
+		}
+	}
+
+	peers, err := h.peers.List()
 	if err != nil {
-		status = http.StatusInternalServerError
-		err = fmt.Errorf("fail to register nodes")
-		log.Printf("there was an error when trying to register a new node %v\n", err)
+		log.Printf("there was an error when trying to list nodes %v\n", err)
+		return response{nil, http.StatusInternalServerError, fmt.Errorf("fail to list nodes")}
 	}
 
-	return response{resp, status, err}
+	resp := map[string]interface{}{"nodes": peers}
+	return response{resp, http.StatusOK, nil}
 }
 
 func (h *handler) ResolveConflicts(w io.Writer, r *http.Request) response {
@@ -233,11 +488,158 @@ func (h *handler) ResolveConflicts(w io.Writer, r *http.Request) response {
 
 	log.Println("Resolving blockchain differences by consensus")
 
+	pk := r.URL.Query().Get("pk")
+	bc := NewBlockchain(pk, h.db)
+
 	msg := "Our chain is authoritative"
-	if h.blockchain.ResolveConflicts() {
-		msg = "Our chain was replaced"
+	if bc.ResolveConflicts(pk, h.db, h.peers.Addresses()) {
+		msg = "Our chain was extended"
 	}
 
-	resp := map[string]interface{}{"message": msg, "chain": h.blockchain.chain}
+	forks, _ := h.db.getForks(pk, []byte(DB_FORKS_NAMESPACE))
+	resp := map[string]interface{}{"message": msg, "chain": bc.chain, "forks": len(forks)}
 	return response{resp, http.StatusOK, nil}
 }
+
+func (h *handler) SyncStatus(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
+		}
+	}
+	log.Println("Sync status requested")
+
+	resp := map[string]interface{}{"peers": h.syncer.Status()}
+	return response{resp, http.StatusOK, nil}
+}
+
+func (h *handler) Forks(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
+		}
+	}
+	log.Println("Forks requested")
+
+	pk := r.URL.Query().Get("pk")
+	id := r.URL.Query().Get("id")
+
+	if id != "" {
+		fork, err := h.db.getFork(pk, id, []byte(DB_FORKS_NAMESPACE))
+		if err != nil {
+			return response{nil, http.StatusNotFound, fmt.Errorf("fork %s not found in the chain of %s", id, pk)}
+		}
+		return response{fork, http.StatusOK, nil}
+	}
+
+	forks, err := h.db.getForks(pk, []byte(DB_FORKS_NAMESPACE))
+	if err != nil {
+		log.Printf("there was an error when trying to list forks %v\n", err)
+		return response{nil, http.StatusInternalServerError, fmt.Errorf("fail to list forks")}
+	}
+
+	resp := map[string]interface{}{"forks": forks}
+	return response{resp, http.StatusOK, nil}
+}
+
+// ForkResolution chooses which branch of a fork is kept: "local" or "branch".
+// It is signed by the owner of the account chain.
+type ForkResolution struct {
+	PublicKey []byte `json:"public_key"`
+	ID        string `json:"id"`
+	Keep      string `json:"keep"`
+	Signature []byte `json:"signature"`
+}
+
+// Hash is what the owner signs, the fork ID and the branch kept.
+func (res *ForkResolution) Hash() []byte {
+	return helpers.SHA256([]byte(res.ID + "\x00" + res.Keep))
+}
+
+func (h *handler) ResolveFork(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodPost {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
+		}
+	}
+	log.Println("Resolving fork")
+
+	var res ForkResolution
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		return response{nil, http.StatusBadRequest, fmt.Errorf("invalid fork resolution: %v", err)}
+	}
+	if res.Keep != "local" && res.Keep != "branch" {
+		return response{nil, http.StatusBadRequest, fmt.Errorf("keep must be \"local\" or \"branch\", not %q", res.Keep)}
+	}
+
+	if len(res.Signature) == 0 || !SignatureVerify(res.PublicKey, res.Signature, res.Hash()) {
+		log.Printf("Invalid fork resolution signature")
+		return response{nil, http.StatusUnauthorized, fmt.Errorf("fork resolution is not signed by the owner of the chain")}
+	}
+
+	pk := string(res.PublicKey)
+	if _, err := h.db.getFork(pk, res.ID, []byte(DB_FORKS_NAMESPACE)); err != nil {
+		return response{nil, http.StatusNotFound, fmt.Errorf("fork %s not found in the chain of %s", res.ID, pk)}
+	}
+	discarded, err := ResolveFork(h.db, pk, res.ID, res.Keep == "branch")
+	if err != nil {
+		return response{nil, http.StatusConflict, err}
+	}
+
+	bc := NewBlockchain(pk, h.db)
+	resp := map[string]interface{}{"message": "Fork resolved", "chain": bc.chain, "discarded": discarded}
+	return response{resp, http.StatusOK, nil}
+}
+
+func (h *handler) Validators(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
+		}
+	}
+	log.Println("Validator set requested")
+
+	if h.consensus == nil {
+		return response{nil, http.StatusNotFound, fmt.Errorf("consensus is not enabled on this node")}
+	}
+	status, err := h.consensus.Status()
+	if err != nil {
+		log.Printf("there was an error when trying to get the consensus status %v\n", err)
+		return response{nil, http.StatusInternalServerError, fmt.Errorf("fail to get the validator set")}
+	}
+
+	return response{status, http.StatusOK, nil}
+}
+
+func (h *handler) ProposeValidator(w io.Writer, r *http.Request) response {
+	if r.Method != http.MethodPost {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowd", r.Method),
+		}
+	}
+	log.Println("Validator proposal received")
+
+	if h.consensus == nil {
+		return response{nil, http.StatusNotFound, fmt.Errorf("consensus is not enabled on this node")}
+	}
+	var p ValidatorProposal
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		return response{nil, http.StatusBadRequest, fmt.Errorf("invalid proposal: %v", err)}
+	}
+	if err := h.consensus.Propose(&p); err != nil {
+		return response{nil, http.StatusBadRequest, fmt.Errorf("Rejected proposal: %v", err)}
+	}
+
+	resp := map[string]interface{}{"message": "Proposal submitted for ordering", "proposal": p}
+	return response{resp, http.StatusAccepted, nil}
+}
@@ -0,0 +1,112 @@
+package qbchain
+
+import (
+	"log"
+	"sort"
+)
+
+// Secondary indexes of the account chains are written with every block, see
+// addBlock, so that lookups do not scan the whole store.
+
+// TransactionBlocks returns the blocks holding a transaction with the given
+// ID, the sender block and the receiver block of a transfer alike.
+func TransactionBlocks(db *DB, transactionID string) (BlockSlice, error) {
+	keys, err := db.scanIndex(indexKey(transactionID), []byte(DB_TRANSACTIONS_INDEX_NAMESPACE))
+	if err != nil {
+		return nil, err
+	}
+	return db.getBlocksByKeys(keys, []byte(DB_NAMESPACE))
+}
+
+// CompanyAccounts returns the accounts that sent transactions on behalf of
+// a company, in key order.
+func CompanyAccounts(db *DB, companyID string) ([]string, error) {
+	owners, err := db.scanIndex(indexKey(companyID), []byte(DB_COMPANIES_INDEX_NAMESPACE))
+	if err != nil {
+		return nil, err
+	}
+	// The company is indexed once per block of every account
+	var accounts []string
+	for i, owner := range owners {
+		if i == 0 || owner != owners[i-1] {
+			accounts = append(accounts, owner)
+		}
+	}
+	return accounts, nil
+}
+
+// CounterpartyBlocks returns the blocks of both chains holding transactions
+// between two accounts, in either direction.
+func CounterpartyBlocks(db *DB, a, b string) (BlockSlice, error) {
+	if a > b {
+		a, b = b, a
+	}
+	keys, err := db.scanIndex(indexKey(a, b), []byte(DB_PAIRS_INDEX_NAMESPACE))
+	if err != nil {
+		return nil, err
+	}
+	return db.getBlocksByKeys(keys, []byte(DB_NAMESPACE))
+}
+
+// BlocksInRange returns the blocks of every chain forged from from to to,
+// both included, ordered by timestamp.
+func BlocksInRange(db *DB, from, to uint32) (BlockSlice, error) {
+	if from > to {
+		return BlockSlice{}, nil
+	}
+	keys, err := db.scanTimeIndex(from, to, []byte(DB_TIMES_INDEX_NAMESPACE))
+	if err != nil {
+		return nil, err
+	}
+	return db.getBlocksByKeys(keys, []byte(DB_NAMESPACE))
+}
+
+// RebuildIndexes drops the submissions and the secondary indexes and writes
+// them again from the blocks in the store, e.g. after an upgrade from a
+// version without them. Blocks stored under the timestamp keys of older
+// versions are moved to the keys of their height first. It returns the
+// number of blocks indexed. The node must not be running.
+func RebuildIndexes(db *DB) (int, error) {
+	for _, namespace := range []string{
+		DB_SUBMISSIONS_NAMESPACE,
+		DB_TRANSACTIONS_INDEX_NAMESPACE,
+		DB_COMPANIES_INDEX_NAMESPACE,
+		DB_PAIRS_INDEX_NAMESPACE,
+		DB_TIMES_INDEX_NAMESPACE,
+	} {
+		if err := db.dropNamespace([]byte(namespace)); err != nil {
+			return 0, err
+		}
+	}
+
+	moved, err := db.rekeyBlocks([]byte(DB_NAMESPACE))
+	if err != nil {
+		return 0, err
+	}
+	if moved > 0 {
+		log.Printf("Moved %d blocks to the keys of their height", moved)
+	}
+
+	chains, err := db.getAllBlocks([]byte(DB_NAMESPACE))
+	if err != nil {
+		return 0, err
+	}
+	accounts := make([]string, 0, len(chains))
+	for account := range chains {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+
+	n := 0
+	for _, account := range accounts {
+		for i := range chains[account] {
+			b := &chains[account][i]
+			if err := db.reindexBlock(b, blockKey([]byte(account), i)); err != nil {
+				return n, err
+			}
+			n++
+		}
+		log.Printf("Indexed the chain of %s", account)
+	}
+	return n, nil
+}
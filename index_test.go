@@ -0,0 +1,97 @@
+package qbchain
+
+import (
+	"fmt"
+	"testing"
+
+	badgerdb "github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexes(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	issuer := GenerateNewKeypair()
+	buyer := GenerateNewKeypair()
+	invoice := makeTestInvoiceTransaction(t, issuer, buyer.Public)
+	block, _, err := forgeBlock(db, []Transaction{invoice}, GenerateNewKeypair())
+	require.NoError(err)
+
+	check := func() {
+		blocks, err := TransactionBlocks(db, "INV-0001")
+		require.NoError(err)
+		require.Len(blocks, 1)
+		require.Equal(block.BlockHash, blocks[0].BlockHash)
+
+		accounts, err := CompanyAccounts(db, "ACME")
+		require.NoError(err)
+		require.Equal([]string{string(issuer.Public)}, accounts)
+		accounts, err = CompanyAccounts(db, "ACM")
+		require.NoError(err)
+		require.Empty(accounts)
+
+		// The pair is the same in either direction
+		blocks, err = CounterpartyBlocks(db, string(buyer.Public), string(issuer.Public))
+		require.NoError(err)
+		require.Len(blocks, 1)
+		blocks, err = CounterpartyBlocks(db, string(buyer.Public), string(GenerateNewKeypair().Public))
+		require.NoError(err)
+		require.Empty(blocks)
+
+		ts := block.BlockHeader.Timestamp
+		blocks, err = BlocksInRange(db, ts, ts)
+		require.NoError(err)
+		require.Len(blocks, 1)
+		blocks, err = BlocksInRange(db, ts+1, ts+100)
+		require.NoError(err)
+		require.Empty(blocks)
+		blocks, err = BlocksInRange(db, 0, ts-1)
+		require.NoError(err)
+		require.Empty(blocks)
+	}
+	check()
+
+	// Rebuilding gives the same indexes, and submissions, from the blocks
+	require.NoError(db.dropNamespace([]byte(DB_TRANSACTIONS_INDEX_NAMESPACE)))
+	require.NoError(db.dropNamespace([]byte(DB_SUBMISSIONS_NAMESPACE)))
+	blocks, err := TransactionBlocks(db, "INV-0001")
+	require.NoError(err)
+	require.Empty(blocks)
+
+	// Blocks stored by older versions are keyed by their first timestamp
+	legacy := []byte(string(issuer.Public) + "_" + fmt.Sprint(invoice.Header.Timestamp))
+	value, err := db.Get([]byte(DB_NAMESPACE), blockKey(issuer.Public, 0))
+	require.NoError(err)
+	require.NoError(db.Delete([]byte(DB_NAMESPACE), blockKey(issuer.Public, 0)))
+	require.NoError(db.Set([]byte(DB_NAMESPACE), legacy, value))
+
+	n, err := RebuildIndexes(db)
+	require.NoError(err)
+	require.Equal(1, n)
+	check()
+	_, err = db.Get([]byte(DB_NAMESPACE), legacy)
+	require.Error(err)
+	forged, err := findSubmission(db, &invoice)
+	require.NoError(err)
+	require.Equal(block.BlockHash, forged.BlockHash)
+
+	// Removing a block removes its entries
+	require.NoError(db.badger.Update(func(txn *badgerdb.Txn) error {
+		return unindexBlock(txn, &block, blockKey(issuer.Public, 0))
+	}))
+	blocks, err = TransactionBlocks(db, "INV-0001")
+	require.NoError(err)
+	require.Empty(blocks)
+	accounts, err := CompanyAccounts(db, "ACME")
+	require.NoError(err)
+	require.Empty(accounts)
+	blocks, err = BlocksInRange(db, 0, block.BlockHeader.Timestamp)
+	require.NoError(err)
+	require.Empty(blocks)
+	forged, err = findSubmission(db, &invoice)
+	require.NoError(err)
+	require.Nil(forged)
+}
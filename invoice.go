@@ -0,0 +1,167 @@
+package qbchain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// InvoiceDateLayout is the layout used for the issue and due dates of an invoice.
+const InvoiceDateLayout = "2006-01-02"
+
+// Invoice is the structured payload carried by an invoice transaction.
+// All amounts are in minor units of Currency (e.g. cents for USD).
+type Invoice struct {
+	Number          string     `json:"number"`
+	IssuerCompanyID string     `json:"issuer_company_id"`
+	BuyerCompanyID  string     `json:"buyer_company_id"`
+	Currency        string     `json:"currency"`
+	IssueDate       string     `json:"issue_date"`
+	DueDate         string     `json:"due_date"`
+	LineItems       []LineItem `json:"line_items"`
+}
+
+type LineItem struct {
+	Description string `json:"description"`
+	Quantity    int64  `json:"quantity"`
+	UnitPrice   int64  `json:"unit_price"`
+	Tax         int64  `json:"tax"`
+}
+
+// Amount returns quantity * unit price + tax for the line item.
+func (li *LineItem) Amount() (int64, error) {
+	if li.Quantity != 0 && li.UnitPrice > (math.MaxInt64-li.Tax)/li.Quantity {
+		return 0, errors.New("line item amount overflows")
+	}
+	return li.Quantity*li.UnitPrice + li.Tax, nil
+}
+
+// Total returns the sum of all line item amounts.
+func (inv *Invoice) Total() (int64, error) {
+	var total int64
+	for i := range inv.LineItems {
+		amount, err := inv.LineItems[i].Amount()
+		if err != nil {
+			return 0, err
+		}
+		if total > math.MaxInt64-amount {
+			return 0, errors.New("invoice total overflows")
+		}
+		total += amount
+	}
+	return total, nil
+}
+
+func (inv *Invoice) Validate() error {
+	if inv.Number == "" {
+		return errors.New("invoice number is required")
+	}
+	if inv.IssuerCompanyID == "" || inv.BuyerCompanyID == "" {
+		return errors.New("issuer and buyer company IDs are required")
+	}
+	if inv.IssuerCompanyID == inv.BuyerCompanyID {
+		return errors.New("issuer and buyer must be different companies")
+	}
+	if !ValidCurrency(inv.Currency) {
+		return fmt.Errorf("unsupported currency code %q", inv.Currency)
+	}
+
+	issued, err := time.Parse(InvoiceDateLayout, inv.IssueDate)
+	if err != nil {
+		return fmt.Errorf("invalid issue date %q", inv.IssueDate)
+	}
+	due, err := time.Parse(InvoiceDateLayout, inv.DueDate)
+	if err != nil {
+		return fmt.Errorf("invalid due date %q", inv.DueDate)
+	}
+	if due.Before(issued) {
+		return errors.New("due date is before issue date")
+	}
+
+	if len(inv.LineItems) == 0 {
+		return errors.New("invoice has no line items")
+	}
+	for i, li := range inv.LineItems {
+		if li.Quantity <= 0 {
+			return fmt.Errorf("line item %d: quantity must be positive", i)
+		}
+		if li.UnitPrice < 0 || li.Tax < 0 {
+			return fmt.Errorf("line item %d: unit price and tax must not be negative", i)
+		}
+	}
+
+	_, err = inv.Total()
+	return err
+}
+
+// MarshalBinary returns the canonical encoding of the invoice, which is what
+// goes into Transaction.Payload.
+func (inv *Invoice) MarshalBinary() ([]byte, error) {
+
+	return json.Marshal(inv)
+}
+
+// UnmarshalBinary decodes a payload and rejects anything that is not in
+// canonical form, so that a given invoice always has a single payload hash.
+func (inv *Invoice) UnmarshalBinary(d []byte) error {
+
+	dec := json.NewDecoder(bytes.NewReader(d))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(inv); err != nil {
+		return fmt.Errorf("invalid invoice payload: %v", err)
+	}
+
+	canonical, err := inv.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(canonical, d) {
+		return errors.New("invoice payload is not canonically encoded")
+	}
+
+	return nil
+}
+
+// Invoice decodes the transaction payload as an invoice.
+func (t *Transaction) Invoice() (*Invoice, error) {
+	inv := new(Invoice)
+	if err := inv.UnmarshalBinary(t.Payload); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// VerifyInvoice checks that the payload is a valid invoice whose number,
+// issuer, currency and total match the transaction header.
+func (t *Transaction) VerifyInvoice() error {
+	inv, err := t.Invoice()
+	if err != nil {
+		return err
+	}
+	if err := inv.Validate(); err != nil {
+		return err
+	}
+
+	if t.Header.TransactionID == "" {
+		return errors.New("invoice transaction has no transaction ID")
+	}
+	if t.Header.TransactionID != inv.Number {
+		return fmt.Errorf("transaction ID %q does not match invoice number %q", t.Header.TransactionID, inv.Number)
+	}
+	if t.Header.CompanyID != inv.IssuerCompanyID {
+		return fmt.Errorf("transaction company %q does not match invoice issuer %q", t.Header.CompanyID, inv.IssuerCompanyID)
+	}
+
+	if t.Header.Currency != inv.Currency {
+		return fmt.Errorf("transaction currency %q does not match invoice currency %q", t.Header.Currency, inv.Currency)
+	}
+	total, _ := inv.Total()
+	if total != t.Header.Amount {
+		return fmt.Errorf("transaction amount %d does not match invoice total %d", t.Header.Amount, total)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package qbchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestInvoice() *Invoice {
+	return &Invoice{
+		Number:          "INV-0001",
+		IssuerCompanyID: "ACME",
+		BuyerCompanyID:  "GLOBEX",
+		Currency:        "USD",
+		IssueDate:       "2018-06-01",
+		DueDate:         "2018-07-01",
+		LineItems: []LineItem{
+			{Description: "Widgets", Quantity: 3, UnitPrice: 1000, Tax: 240},
+			{Description: "Shipping", Quantity: 1, UnitPrice: 500},
+		},
+	}
+}
+
+func TestInvoiceTotal(t *testing.T) {
+	require := require.New(t)
+
+	total, err := makeTestInvoice().Total()
+	require.NoError(err)
+	require.Equal(int64(3740), total)
+}
+
+func TestInvoiceValidate(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(makeTestInvoice().Validate())
+
+	inv := makeTestInvoice()
+	inv.Currency = "usd"
+	require.Error(inv.Validate())
+
+	inv = makeTestInvoice()
+	inv.DueDate = "2018-05-01"
+	require.Error(inv.Validate())
+
+	inv = makeTestInvoice()
+	inv.LineItems[0].Quantity = 0
+	require.Error(inv.Validate())
+
+	inv = makeTestInvoice()
+	inv.LineItems = nil
+	require.Error(inv.Validate())
+}
+
+func TestInvoiceCanonicalEncoding(t *testing.T) {
+	require := require.New(t)
+
+	inv := makeTestInvoice()
+	payload, err := inv.MarshalBinary()
+	require.NoError(err)
+
+	decoded := new(Invoice)
+	require.NoError(decoded.UnmarshalBinary(payload))
+	require.Equal(inv, decoded)
+
+	// Same invoice, different whitespace: must be rejected
+	spaced := append([]byte(" "), payload...)
+	require.Error(new(Invoice).UnmarshalBinary(spaced))
+
+	require.Error(new(Invoice).UnmarshalBinary([]byte(`{"number":"1","extra":true}`)))
+}
+
+func TestTransactionVerifyInvoice(t *testing.T) {
+	require := require.New(t)
+
+	keypair := GenerateNewKeypair()
+	tx, err := NewInvoiceTransaction(keypair.Public, GenerateNewKeypair().Public, makeTestInvoice())
+	require.NoError(err)
+	require.Equal(int64(3740), tx.Header.Amount)
+	require.Equal("INV-0001", tx.Header.TransactionID)
+	require.NoError(tx.VerifyInvoice())
+
+	tx.Header.Currency = "EUR"
+	require.Error(tx.VerifyInvoice())
+	tx.Header.Currency = "USD"
+
+	tx.Header.Amount = 1
+	require.Error(tx.VerifyInvoice())
+	tx.Header.Amount = 3740
+
+	// The header must name the invoice and its issuer as the payload does
+	tx.Header.TransactionID = "INV-0002"
+	require.Error(tx.VerifyInvoice())
+	tx.Header.TransactionID = ""
+	require.Error(tx.VerifyInvoice())
+	tx.Header.TransactionID = "INV-0001"
+
+	tx.Header.CompanyID = "GLOBEX"
+	require.Error(tx.VerifyInvoice())
+	tx.Header.CompanyID = "ACME"
+	require.NoError(tx.VerifyInvoice())
+
+	tx.Payload = []byte("not an invoice")
+	require.Error(tx.VerifyInvoice())
+}
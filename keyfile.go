@@ -0,0 +1,125 @@
+package qbchain
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// EncryptedKeypair is a keypair whose private key is sealed with AES-256-GCM
+// under a key derived from a passphrase with scrypt. The public key is
+// authenticated as additional data, so it cannot be swapped in the file.
+type EncryptedKeypair struct {
+	Public     string `json:"public"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func EncryptKeypair(kp *Keypair, passphrase string) (*EncryptedKeypair, error) {
+	e := &EncryptedKeypair{
+		Public: string(kp.Public),
+		KDF:    "scrypt",
+		N:      SCRYPT_N,
+		R:      SCRYPT_R,
+		P:      SCRYPT_P,
+		Salt:   make([]byte, 32),
+	}
+	if _, err := rand.Read(e.Salt); err != nil {
+		return nil, err
+	}
+
+	gcm, err := e.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	e.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	e.Ciphertext = gcm.Seal(nil, e.Nonce, kp.Private, kp.Public)
+	return e, nil
+}
+
+func (e *EncryptedKeypair) Decrypt(passphrase string) (*Keypair, error) {
+	gcm, err := e.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	private, err := gcm.Open(nil, e.Nonce, e.Ciphertext, []byte(e.Public))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted key")
+	}
+	return &Keypair{Public: []byte(e.Public), Private: private}, nil
+}
+
+func (e *EncryptedKeypair) cipher(passphrase string) (cipher.AEAD, error) {
+	if e.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported key derivation function %q", e.KDF)
+	}
+	if e.N <= 1 || e.N&(e.N-1) != 0 || e.N > SCRYPT_MAX_N {
+		return nil, fmt.Errorf("scrypt N %d is not a power of two up to %d", e.N, SCRYPT_MAX_N)
+	}
+	if e.R < 1 || e.P < 1 || e.P > SCRYPT_MAX_P {
+		return nil, fmt.Errorf("scrypt r %d or p %d is out of bounds", e.R, e.P)
+	}
+	if 128*e.N*e.R > SCRYPT_MAX_MEMORY || 128*e.R*e.P > SCRYPT_MAX_MEMORY {
+		return nil, fmt.Errorf("scrypt parameters N %d, r %d, p %d need too much memory", e.N, e.R, e.P)
+	}
+	key, err := scrypt.Key([]byte(passphrase), e.Salt, e.N, e.R, e.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadNodeKeypair reads the keypair of the node from an encrypted key file.
+// On the first boot, when the file does not exist, a new keypair is
+// generated and written to it. The passphrase may not be empty.
+func LoadNodeKeypair(path, passphrase string) (*Keypair, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("set %s to the passphrase of the node key", NODE_PASSPHRASE_ENV)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		kp := GenerateNewKeypair()
+		e, err := EncryptKeypair(kp, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.MarshalIndent(e, "", "  "); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated node key %s in %s", kp.Public, path)
+		return kp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var e EncryptedKeypair
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %v", path, err)
+	}
+	return e.Decrypt(passphrase)
+}
@@ -0,0 +1,77 @@
+package qbchain
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptKeypair(t *testing.T) {
+	require := require.New(t)
+
+	kp := GenerateNewKeypair()
+	e, err := EncryptKeypair(kp, "secret")
+	require.NoError(err)
+	require.NotContains(string(e.Ciphertext), string(kp.Private))
+
+	decrypted, err := e.Decrypt("secret")
+	require.NoError(err)
+	require.Equal(kp, decrypted)
+
+	_, err = e.Decrypt("wrong")
+	require.Error(err)
+
+	// The public key cannot be replaced
+	e.Public = string(GenerateNewKeypair().Public)
+	_, err = e.Decrypt("secret")
+	require.Error(err)
+
+	// Nor the scrypt parameters raised beyond their bounds
+	for _, n := range []int{0, 3, SCRYPT_MAX_N << 1} {
+		bad := *e
+		bad.N = n
+		_, err = bad.Decrypt("secret")
+		require.Error(err)
+	}
+	bad := *e
+	bad.P = SCRYPT_MAX_P + 1
+	_, err = bad.Decrypt("secret")
+	require.Error(err)
+	bad = *e
+	bad.R = SCRYPT_MAX_MEMORY
+	_, err = bad.Decrypt("secret")
+	require.Error(err)
+}
+
+func TestLoadNodeKeypair(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "qbchain-key-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, NODE_KEY_FILE)
+
+	kp, err := LoadNodeKeypair(file, "secret")
+	require.NoError(err)
+	info, err := os.Stat(file)
+	require.NoError(err)
+	require.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	// The same key is loaded on the next boot
+	again, err := LoadNodeKeypair(file, "secret")
+	require.NoError(err)
+	require.Equal(kp, again)
+
+	_, err = LoadNodeKeypair(file, "wrong")
+	require.Error(err)
+
+	// No key is written without a passphrase
+	empty := path.Join(dir, "empty.key")
+	_, err = LoadNodeKeypair(empty, "")
+	require.Error(err)
+	_, err = os.Stat(empty)
+	require.True(os.IsNotExist(err))
+}
@@ -0,0 +1,367 @@
+package qbchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TransactionKind tells what a transaction does to an invoice. Every kind
+// other than KindInvoice refers to the original invoice through
+// TransactionHeader.Reference.
+type TransactionKind uint8
+
+const (
+	KindInvoice TransactionKind = iota
+	KindAcknowledge
+	KindPayment
+	KindDispute
+	KindVoid
+)
+
+var kindNames = []string{"invoice", "acknowledge", "payment", "dispute", "void"}
+
+func (k TransactionKind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("kind(%d)", k)
+}
+
+// ParseTransactionKind accepts the name or the number of a kind.
+func ParseTransactionKind(s string) (TransactionKind, error) {
+	for i, name := range kindNames {
+		if strings.EqualFold(s, name) {
+			return TransactionKind(i), nil
+		}
+	}
+	k, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || int(k) >= len(kindNames) {
+		return 0, fmt.Errorf("unknown transaction kind %q", s)
+	}
+	return TransactionKind(k), nil
+}
+
+type InvoiceState uint8
+
+const (
+	InvoiceIssued InvoiceState = iota
+	InvoiceAcknowledged
+	InvoicePartiallyPaid
+	InvoicePaid
+	InvoiceDisputed
+	InvoiceVoided
+)
+
+var stateNames = []string{"issued", "acknowledged", "partially_paid", "paid", "disputed", "voided"}
+
+func (s InvoiceState) String() string {
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("state(%d)", s)
+}
+
+func (s InvoiceState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// transitions lists, for every state, the kinds of follow-up transaction that
+// may be applied to it. Paid and voided invoices are final.
+var transitions = map[InvoiceState][]TransactionKind{
+	InvoiceIssued:        {KindAcknowledge, KindPayment, KindDispute, KindVoid},
+	InvoiceAcknowledged:  {KindPayment, KindDispute, KindVoid},
+	InvoicePartiallyPaid: {KindPayment, KindDispute},
+	InvoiceDisputed:      {KindAcknowledge, KindPayment, KindVoid},
+}
+
+// InvoiceStatus is the state of an invoice derived by replaying its
+// transactions in order.
+type InvoiceStatus struct {
+	InvoiceID string        `json:"invoice_id"`
+	Issuer    []byte        `json:"issuer"`
+	Buyer     []byte        `json:"buyer"`
+	Currency  string        `json:"currency"`
+	Total     int64         `json:"total"`
+	Paid      int64         `json:"paid"`
+	State     InvoiceState  `json:"state"`
+	History   []Transaction `json:"history"`
+}
+
+func NewInvoiceStatus(invoice Transaction) (*InvoiceStatus, error) {
+	if invoice.Header.Kind != KindInvoice {
+		return nil, fmt.Errorf("transaction %s is not an invoice", invoice.Header.TransactionID)
+	}
+
+	return &InvoiceStatus{
+		InvoiceID: invoice.Header.TransactionID,
+		Issuer:    invoice.Header.From,
+		Buyer:     invoice.Header.To,
+		Currency:  invoice.Header.Currency,
+		Total:     invoice.Header.Amount,
+		State:     InvoiceIssued,
+		History:   []Transaction{invoice},
+	}, nil
+}
+
+// Apply moves the invoice to its next state, or returns an error if the
+// transaction is not a legal follow-up in the current state.
+func (s *InvoiceStatus) Apply(t Transaction) error {
+	kind := t.Header.Kind
+	if t.Header.Reference != s.InvoiceID {
+		return fmt.Errorf("transaction %s does not reference invoice %s", t.Header.TransactionID, s.InvoiceID)
+	}
+
+	if t.Header.Currency != s.Currency {
+		return fmt.Errorf("currency %q does not match invoice currency %q", t.Header.Currency, s.Currency)
+	}
+
+	allowed := false
+	for _, k := range transitions[s.State] {
+		if k == kind {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("cannot %s an invoice that is %s", kind, s.State)
+	}
+
+	// Only the issuer may void an invoice, everything else comes from the buyer
+	from, to := s.Buyer, s.Issuer
+	if kind == KindVoid {
+		from, to = s.Issuer, s.Buyer
+	}
+	if !bytes.Equal(t.Header.From, from) || !bytes.Equal(t.Header.To, to) {
+		return fmt.Errorf("%s of invoice %s must be sent from %s to %s", kind, s.InvoiceID, from, to)
+	}
+
+	if kind == KindPayment {
+		if t.Header.Amount <= 0 {
+			return errors.New("payment amount must be positive")
+		}
+		if t.Header.Amount > s.Total-s.Paid {
+			return fmt.Errorf("payment of %d exceeds outstanding amount %d", t.Header.Amount, s.Total-s.Paid)
+		}
+	} else if t.Header.Amount != 0 {
+		return fmt.Errorf("%s must not carry an amount", kind)
+	}
+
+	switch kind {
+	case KindAcknowledge:
+		s.State = InvoiceAcknowledged
+	case KindPayment:
+		s.Paid += t.Header.Amount
+		s.State = InvoicePartiallyPaid
+		if s.Paid == s.Total {
+			s.State = InvoicePaid
+		}
+	case KindDispute:
+		s.State = InvoiceDisputed
+	case KindVoid:
+		s.State = InvoiceVoided
+	}
+	s.History = append(s.History, t)
+
+	return nil
+}
+
+// authoredTransactions returns the transactions of the chain as their sender
+// signed them, see Block.AuthoredTransactions.
+func authoredTransactions(bc *Blockchain) []Transaction {
+	var txns []Transaction
+	for i := range bc.chain {
+		txns = append(txns, bc.chain[i].AuthoredTransactions()...)
+	}
+	return txns
+}
+
+// invoiceIssuer returns the issuer of the invoice a transaction is or
+// refers to: invoices and voids are sent by the issuer, the other follow-ups
+// to it.
+func invoiceIssuer(t *Transaction) []byte {
+	if t.Header.Kind == KindInvoice || t.Header.Kind == KindVoid {
+		return t.Header.From
+	}
+	return t.Header.To
+}
+
+// invoiceKey identifies an invoice, or a transaction, by its sender and ID,
+// as IDs are only unique per sender.
+func invoiceKey(sender []byte, id string) string {
+	return string(sender) + "\x00" + id
+}
+
+// LoadInvoiceStatus derives the state of the invoice invoiceID of issuer
+// from the chains of both the issuer and the buyer. pk may be the key of
+// either party. An empty issuer matches any, as long as a single invoice of
+// pk's chain has that ID.
+func LoadInvoiceStatus(db *DB, pk string, issuer string, invoiceID string) (*InvoiceStatus, error) {
+	return loadInvoiceStatus(func(account string) *Blockchain {
+		return NewBlockchain(account, db)
+	}, pk, issuer, invoiceID)
+}
+
+// loadInvoiceStatus is LoadInvoiceStatus with the chains of the parties
+// returned by chainOf, so that a chain can be checked before it is stored.
+func loadInvoiceStatus(chainOf func(account string) *Blockchain, pk string, issuer string, invoiceID string) (*InvoiceStatus, error) {
+	var status *InvoiceStatus
+	for _, t := range authoredTransactions(chainOf(pk)) {
+		if t.Header.Kind != KindInvoice || t.Header.TransactionID != invoiceID {
+			continue
+		}
+		if issuer != "" && string(t.Header.From) != issuer {
+			continue
+		}
+		if status != nil && !bytes.Equal(status.Issuer, t.Header.From) {
+			return nil, fmt.Errorf("invoice %s was issued by more than one account, the issuer must be given", invoiceID)
+		}
+		status, _ = NewInvoiceStatus(t)
+	}
+	if status == nil {
+		return nil, fmt.Errorf("invoice %s not found", invoiceID)
+	}
+
+	// A follow-up is in the chains of both parties. It is recognised by its
+	// hash, as a TransactionID is optional
+	seen := map[string]bool{}
+	var related []Transaction
+	for _, party := range [][]byte{status.Issuer, status.Buyer} {
+		for _, t := range authoredTransactions(chainOf(string(party))) {
+			key := string(t.Hash())
+			if t.Header.Kind == KindInvoice || t.Header.Reference != invoiceID || seen[key] {
+				continue
+			}
+			if !bytes.Equal(invoiceIssuer(&t), status.Issuer) {
+				continue
+			}
+			seen[key] = true
+			related = append(related, t)
+		}
+	}
+
+	if err := status.replay(related); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// replay applies the follow-up transactions in timestamp order.
+func (s *InvoiceStatus) replay(related []Transaction) error {
+	sort.SliceStable(related, func(i, j int) bool {
+		return related[i].Header.Timestamp < related[j].Header.Timestamp
+	})
+
+	for _, t := range related {
+		if err := s.Apply(t); err != nil {
+			return fmt.Errorf("invoice %s has an invalid history: %v", s.InvoiceID, err)
+		}
+	}
+	return nil
+}
+
+// InvoiceStatuses derives the state of every invoice in the store, taking
+// into account only transactions with a timestamp up to asOf. Invoices with
+// an invalid history are left out.
+func InvoiceStatuses(db *DB, asOf time.Time) ([]*InvoiceStatus, error) {
+	chains, err := db.getAllBlocks([]byte(DB_NAMESPACE))
+	if err != nil {
+		return nil, err
+	}
+
+	until := uint32(asOf.Unix())
+	invoices := make(map[string]*InvoiceStatus)
+	related := make(map[string][]Transaction)
+	seen := make(map[string]bool)
+	for _, chain := range chains {
+		for _, t := range authoredTransactions(&Blockchain{chain: chain}) {
+			hash := string(t.Hash())
+			if t.Header.Timestamp > until || seen[hash] {
+				continue
+			}
+			seen[hash] = true
+
+			if t.Header.Kind == KindInvoice {
+				invoices[invoiceKey(t.Header.From, t.Header.TransactionID)], _ = NewInvoiceStatus(t)
+			} else {
+				invoice := invoiceKey(invoiceIssuer(&t), t.Header.Reference)
+				related[invoice] = append(related[invoice], t)
+			}
+		}
+	}
+
+	statuses := make([]*InvoiceStatus, 0, len(invoices))
+	for key, status := range invoices {
+		if err := status.replay(related[key]); err != nil {
+			log.Printf("Left out invoice %s of %s: %v", status.InvoiceID, status.Issuer, err)
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].InvoiceID != statuses[j].InvoiceID {
+			return statuses[i].InvoiceID < statuses[j].InvoiceID
+		}
+		return bytes.Compare(statuses[i].Issuer, statuses[j].Issuer) < 0
+	})
+
+	return statuses, nil
+}
+
+// VerifyLifecycle checks that a new transaction is a valid invoice, or a
+// legal follow-up to the invoice it references.
+func VerifyLifecycle(db *DB, t *Transaction) error {
+	return verifyLifecycle(db, t, nil)
+}
+
+// verifyLifecycle is VerifyLifecycle for a transaction that follows others
+// which are not in the store yet. statuses holds the invoices referenced by
+// those transactions by invoiceKey, with the transactions applied, and is
+// updated with t.
+func verifyLifecycle(db *DB, t *Transaction, statuses map[string]*InvoiceStatus) error {
+	if !ValidCurrency(t.Header.Currency) {
+		return fmt.Errorf("unsupported currency code %q", t.Header.Currency)
+	}
+	if t.Header.Kind == KindInvoice {
+		if err := t.VerifyInvoice(); err != nil {
+			return err
+		}
+		if statuses != nil {
+			statuses[invoiceKey(t.Header.From, t.Header.TransactionID)], _ = NewInvoiceStatus(*t)
+		}
+		return nil
+	}
+	if int(t.Header.Kind) >= len(kindNames) {
+		return fmt.Errorf("unknown transaction kind %d", t.Header.Kind)
+	}
+	if t.Header.Reference == "" {
+		return fmt.Errorf("%s must reference an invoice", t.Header.Kind)
+	}
+
+	issuer := invoiceIssuer(t)
+	key := invoiceKey(issuer, t.Header.Reference)
+	status, ok := statuses[key]
+	if !ok {
+		// The invoice may still be pending on the sender's side, so fall
+		// back to the counterparty's chain
+		var err error
+		status, err = LoadInvoiceStatus(db, string(t.Header.From), string(issuer), t.Header.Reference)
+		if err != nil {
+			status, err = LoadInvoiceStatus(db, string(t.Header.To), string(issuer), t.Header.Reference)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := status.Apply(*t); err != nil {
+		return err
+	}
+	if statuses != nil {
+		statuses[key] = status
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package qbchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTransactionKind(t *testing.T) {
+	require := require.New(t)
+
+	for s, kind := range map[string]TransactionKind{"invoice": KindInvoice, "Payment": KindPayment, "4": KindVoid} {
+		k, err := ParseTransactionKind(s)
+		require.NoError(err)
+		require.Equal(kind, k)
+	}
+	for _, s := range []string{"", "refund", "5"} {
+		_, err := ParseTransactionKind(s)
+		require.Error(err, s)
+	}
+}
+
+func TestInvoiceLifecycle(t *testing.T) {
+	require := require.New(t)
+
+	issuer := GenerateNewKeypair().Public
+	buyer := GenerateNewKeypair().Public
+	invoice, err := NewInvoiceTransaction(issuer, buyer, makeTestInvoice())
+	require.NoError(err)
+
+	status, err := NewInvoiceStatus(invoice)
+	require.NoError(err)
+	require.Equal(InvoiceIssued, status.State)
+
+	ack := NewFollowUpTransaction(buyer, issuer, KindAcknowledge, "INV-0001", "ACK-1", 0, "USD", nil)
+	require.NoError(status.Apply(ack))
+	require.Equal(InvoiceAcknowledged, status.State)
+
+	// Payments come from the buyer and cannot exceed the outstanding amount
+	require.Error(status.Apply(NewFollowUpTransaction(issuer, buyer, KindPayment, "INV-0001", "PAY-0", 100, "USD", nil)))
+	require.Error(status.Apply(NewFollowUpTransaction(buyer, issuer, KindPayment, "INV-0001", "PAY-0", 5000, "USD", nil)))
+
+	// Payments must be in the currency of the invoice
+	require.Error(status.Apply(NewFollowUpTransaction(buyer, issuer, KindPayment, "INV-0001", "PAY-1", 1000, "EUR", nil)))
+
+	require.NoError(status.Apply(NewFollowUpTransaction(buyer, issuer, KindPayment, "INV-0001", "PAY-1", 1000, "USD", nil)))
+	require.Equal(InvoicePartiallyPaid, status.State)
+
+	// Partially paid invoices can no longer be voided
+	require.Error(status.Apply(NewFollowUpTransaction(issuer, buyer, KindVoid, "INV-0001", "VOID-1", 0, "USD", nil)))
+
+	require.NoError(status.Apply(NewFollowUpTransaction(buyer, issuer, KindPayment, "INV-0001", "PAY-2", 2740, "USD", nil)))
+	require.Equal(InvoicePaid, status.State)
+	require.Equal(int64(3740), status.Paid)
+	require.Len(status.History, 4)
+
+	require.Error(status.Apply(NewFollowUpTransaction(buyer, issuer, KindDispute, "INV-0001", "DSP-1", 0, "USD", nil)))
+}
+
+func TestInvoiceLifecycleVoided(t *testing.T) {
+	require := require.New(t)
+
+	issuer := GenerateNewKeypair().Public
+	buyer := GenerateNewKeypair().Public
+	invoice, err := NewInvoiceTransaction(issuer, buyer, makeTestInvoice())
+	require.NoError(err)
+	status, _ := NewInvoiceStatus(invoice)
+
+	// Only the issuer may void
+	require.Error(status.Apply(NewFollowUpTransaction(buyer, issuer, KindVoid, "INV-0001", "VOID-1", 0, "USD", nil)))
+	require.NoError(status.Apply(NewFollowUpTransaction(issuer, buyer, KindVoid, "INV-0001", "VOID-1", 0, "USD", nil)))
+	require.Equal(InvoiceVoided, status.State)
+
+	require.Error(status.Apply(NewFollowUpTransaction(buyer, issuer, KindPayment, "INV-0001", "PAY-1", 100, "USD", nil)))
+	require.Error(status.Apply(NewFollowUpTransaction(buyer, issuer, KindAcknowledge, "INV-0002", "ACK-1", 0, "USD", nil)))
+}
+
+func TestInvoiceStatuses(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	issuer := GenerateNewKeypair().Public
+	buyer := GenerateNewKeypair().Public
+	invoice, err := NewInvoiceTransaction(issuer, buyer, makeTestInvoice())
+	require.NoError(err)
+	invoice.Header.Timestamp = 1000
+	forgeTestTransfer(db, invoice, func(*Transaction) {})
+
+	payment := NewFollowUpTransaction(buyer, issuer, KindPayment, "INV-0001", "PAY-1", 1000, "USD", nil)
+	payment.Header.Timestamp = 2000
+	forgeTestTransfer(db, payment, func(*Transaction) {})
+
+	statuses, err := InvoiceStatuses(db, time.Unix(1500, 0))
+	require.NoError(err)
+	require.Len(statuses, 1)
+	require.Equal(InvoiceIssued, statuses[0].State)
+
+	statuses, err = InvoiceStatuses(db, time.Unix(2500, 0))
+	require.NoError(err)
+	require.Equal(InvoicePartiallyPaid, statuses[0].State)
+	require.Equal(int64(1000), statuses[0].Paid)
+
+	status, err := LoadInvoiceStatus(db, string(buyer), "", "INV-0001")
+	require.NoError(err)
+	require.Equal(InvoicePartiallyPaid, status.State)
+}
+
+// Invoice IDs are only unique per issuer
+func TestInvoiceStatusSameIDTwoIssuers(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	issuer := GenerateNewKeypair().Public
+	other := GenerateNewKeypair().Public
+	buyer := GenerateNewKeypair().Public
+	for i, from := range [][]byte{issuer, other} {
+		invoice, err := NewInvoiceTransaction(from, buyer, makeTestInvoice())
+		require.NoError(err)
+		invoice.Header.Timestamp = uint32(1000 + i)
+		forgeTestTransfer(db, invoice, func(*Transaction) {})
+	}
+	payment := NewFollowUpTransaction(buyer, issuer, KindPayment, "INV-0001", "PAY-1", 1000, "USD", nil)
+	payment.Header.Timestamp = 2000
+	forgeTestTransfer(db, payment, func(*Transaction) {})
+
+	// A payment to the other issuer is checked against its own invoice
+	full := NewFollowUpTransaction(buyer, other, KindPayment, "INV-0001", "PAY-2", 1000, "USD", nil)
+	require.NoError(VerifyLifecycle(db, &full))
+
+	status, err := LoadInvoiceStatus(db, string(buyer), string(issuer), "INV-0001")
+	require.NoError(err)
+	require.Equal(issuer, status.Issuer)
+	require.Equal(InvoicePartiallyPaid, status.State)
+	require.Len(status.History, 2)
+
+	status, err = LoadInvoiceStatus(db, string(buyer), string(other), "INV-0001")
+	require.NoError(err)
+	require.Equal(InvoiceIssued, status.State)
+
+	_, err = LoadInvoiceStatus(db, string(buyer), "", "INV-0001")
+	require.Error(err)
+
+	statuses, err := InvoiceStatuses(db, time.Unix(3000, 0))
+	require.NoError(err)
+	require.Len(statuses, 2)
+
+	// An invoice whose history does not replay is left out of the reports
+	overpaid := NewFollowUpTransaction(buyer, other, KindPayment, "INV-0001", "PAY-3", status.Total+1, "USD", nil)
+	overpaid.Header.Timestamp = 2500
+	forgeTestTransfer(db, overpaid, func(*Transaction) {})
+	statuses, err = InvoiceStatuses(db, time.Unix(3000, 0))
+	require.NoError(err)
+	require.Len(statuses, 1)
+	require.Equal(issuer, statuses[0].Issuer)
+}
+
+// Follow-ups without a TransactionID are told apart by their hash
+func TestInvoiceStatusPaymentsWithoutID(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	issuer := GenerateNewKeypair().Public
+	buyer := GenerateNewKeypair().Public
+	invoice, err := NewInvoiceTransaction(issuer, buyer, makeTestInvoice())
+	require.NoError(err)
+	invoice.Header.Timestamp = 1000
+	forgeTestTransfer(db, invoice, func(*Transaction) {})
+
+	for i, amount := range []int64{3000, 740} {
+		payment := NewFollowUpTransaction(buyer, issuer, KindPayment, "INV-0001", "", amount, "USD", nil)
+		payment.Header.Timestamp = uint32(2000 + i)
+		require.NoError(VerifyLifecycle(db, &payment))
+		forgeTestTransfer(db, payment, func(*Transaction) {})
+	}
+
+	status, err := LoadInvoiceStatus(db, string(buyer), string(issuer), "INV-0001")
+	require.NoError(err)
+	require.Equal(InvoicePaid, status.State)
+	require.Equal(int64(3740), status.Paid)
+	require.Len(status.History, 3)
+
+	again := NewFollowUpTransaction(buyer, issuer, KindPayment, "INV-0001", "", 740, "USD", nil)
+	again.Header.Timestamp = 2002
+	require.Error(VerifyLifecycle(db, &again))
+
+	statuses, err := InvoiceStatuses(db, time.Unix(3000, 0))
+	require.NoError(err)
+	require.Len(statuses, 1)
+	require.Equal(int64(3740), statuses[0].Paid)
+}
@@ -0,0 +1,47 @@
+package mempool
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// NewHandler serves /mempool, which lists the pending transactions ordered
+// by the time they were added. The query parameter pk restricts the list to
+// the transactions sent by one account, in the order they will be forged.
+func NewHandler(pool *Pool) http.Handler {
+	h := handler{pool}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mempool", h.Pending)
+	return mux
+}
+
+type handler struct {
+	pool *Pool
+}
+
+func (h *handler) Pending(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowd", r.Method))
+		return
+	}
+	log.Println("Mempool requested")
+
+	entries := h.pool.Pending(r.URL.Query().Get("pk"))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pending":  entries,
+		"length":   len(entries),
+		"size":     h.pool.Len(),
+		"max_size": h.pool.maxSize,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("could not encode response to output: %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+// Package mempool holds the transactions a ledger node has accepted but not
+// yet forged into blocks.
+package mempool
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	".."
+)
+
+// Entry is a transaction waiting in the pool.
+type Entry struct {
+	Transaction qbchain.Transaction `json:"transaction"`
+	AddedAt     time.Time           `json:"added_at"`
+}
+
+// Pool keeps the pending transactions of every account ordered by timestamp,
+// and by arrival for the same timestamp, as a node stamps many transactions
+// of an account in the same second. Every transaction is checked when it is
+// added, so that the producer only has to check it again against the blocks
+// forged in the meantime.
+type Pool struct {
+	db             *qbchain.DB
+	maxSize        int
+	maxAccountSize int
+
+	mu       sync.Mutex
+	accounts map[string][]Entry
+	hashes   map[string]bool
+	ids      map[string]bool
+	size     int
+}
+
+// New creates a pool holding at most maxSize transactions, of which at most
+// maxAccountSize are sent by the same account.
+func New(db *qbchain.DB, maxSize, maxAccountSize int) *Pool {
+	return &Pool{
+		db:             db,
+		maxSize:        maxSize,
+		maxAccountSize: maxAccountSize,
+		accounts:       make(map[string][]Entry),
+		hashes:         make(map[string]bool),
+		ids:            make(map[string]bool),
+	}
+}
+
+func idKey(t *qbchain.Transaction) string {
+	return string(t.Header.From) + "_" + t.Header.TransactionID
+}
+
+// Add checks a transaction and adds it to the pool. If the pool is full the
+// latest transaction of the account with the most pending transactions is
+// evicted to make room, unless that is the account of t.
+func (p *Pool) Add(t qbchain.Transaction) error {
+	if t.Header.Version != qbchain.TRANSACTION_HEADER_VERSION {
+		return fmt.Errorf("unsupported transaction header version %d", t.Header.Version)
+	}
+	if !t.VerifyTransaction(qbchain.TRANSACTION_POW) {
+		return errors.New("invalid signature, proof of work or payload")
+	}
+	if err := qbchain.VerifyLifecycle(p.db, &t); err != nil {
+		return err
+	}
+
+	account := string(t.Header.From)
+	hash := t.Hash()
+	bc := qbchain.NewBlockchain(account, p.db)
+	if bc.HasTransaction(hash) {
+		return fmt.Errorf("transaction %x is already in the chain", hash)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.hashes[string(hash)] {
+		return qbchain.ErrAlreadyPending
+	}
+	if t.Header.TransactionID != "" && p.ids[idKey(&t)] {
+		return &qbchain.ConflictError{TransactionID: t.Header.TransactionID}
+	}
+	pending := p.accounts[account]
+	if len(pending) >= p.maxAccountSize {
+		return fmt.Errorf("%s has %d pending transactions", account, len(pending))
+	}
+	if p.size >= p.maxSize && !p.evict(account) {
+		return qbchain.ErrMempoolFull
+	}
+
+	// Transactions with the same timestamp stay in the order they arrived
+	i := sort.Search(len(pending), func(i int) bool {
+		return pending[i].Transaction.Header.Timestamp > t.Header.Timestamp
+	})
+	pending = append(pending, Entry{})
+	copy(pending[i+1:], pending[i:])
+	pending[i] = Entry{t, time.Now()}
+	p.accounts[account] = pending
+
+	p.hashes[string(hash)] = true
+	if t.Header.TransactionID != "" {
+		p.ids[idKey(&t)] = true
+	}
+	p.size++
+	return nil
+}
+
+// Has tells whether the transaction with the given hash is pending.
+func (p *Pool) Has(hash []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.hashes[string(hash)]
+}
+
+// evict removes the latest transaction of the account with the most pending
+// transactions, if it has more than account will have after an insertion.
+func (p *Pool) evict(account string) bool {
+	var largest string
+	for a, pending := range p.accounts {
+		if len(pending) > len(p.accounts[largest]) || (len(pending) == len(p.accounts[largest]) && a < largest) {
+			largest = a
+		}
+	}
+	if len(p.accounts[largest]) <= len(p.accounts[account])+1 {
+		return false
+	}
+
+	pending := p.accounts[largest]
+	evicted := pending[len(pending)-1].Transaction
+	p.remove(largest, len(pending)-1, len(pending))
+	log.Printf("Mempool is full, evicted transaction %x of %s", evicted.Hash(), largest)
+	return true
+}
+
+// remove drops the pending transactions of an account from i to j.
+func (p *Pool) remove(account string, i, j int) {
+	pending := p.accounts[account]
+	for _, e := range pending[i:j] {
+		delete(p.hashes, string(e.Transaction.Hash()))
+		if e.Transaction.Header.TransactionID != "" {
+			delete(p.ids, idKey(&e.Transaction))
+		}
+	}
+	p.size -= j - i
+
+	pending = append(pending[:i:i], pending[j:]...)
+	if len(pending) == 0 {
+		delete(p.accounts, account)
+	} else {
+		p.accounts[account] = pending
+	}
+}
+
+// Accounts returns the accounts with pending transactions in order.
+func (p *Pool) Accounts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	accounts := make([]string, 0, len(p.accounts))
+	for a := range p.accounts {
+		accounts = append(accounts, a)
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+// Take removes and returns up to max of the oldest pending transactions of
+// an account.
+func (p *Pool) Take(account string, max int) []qbchain.Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending := p.accounts[account]
+	if max > len(pending) {
+		max = len(pending)
+	}
+	txns := make([]qbchain.Transaction, max)
+	for i := range txns {
+		txns[i] = pending[i].Transaction
+	}
+	p.remove(account, 0, max)
+	return txns
+}
+
+// Pending returns the pending transactions of an account, or of every
+// account if account is empty.
+func (p *Pool) Pending(account string) []Entry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if account != "" {
+		return append([]Entry{}, p.accounts[account]...)
+	}
+	entries := make([]Entry, 0, p.size)
+	for _, pending := range p.accounts {
+		entries = append(entries, pending...)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].AddedAt.Before(entries[j].AddedAt) })
+	return entries
+}
+
+// Len is the number of pending transactions.
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.size
+}
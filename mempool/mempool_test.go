@@ -0,0 +1,102 @@
+package mempool
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	".."
+)
+
+func makeDB(t *testing.T) (*qbchain.DB, func()) {
+	tmpDir, err := ioutil.TempDir("", "db-mempool-test")
+	require.NoError(t, err)
+	db, err := qbchain.New(path.Join(tmpDir, "data"), path.Join(tmpDir, "meta"))
+	require.NoError(t, err)
+	return db, func() {
+		db.Close()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func makeInvoice(t *testing.T, issuer *qbchain.Keypair, number string, timestamp uint32) qbchain.Transaction {
+	inv := &qbchain.Invoice{
+		Number:          number,
+		IssuerCompanyID: "ACME",
+		BuyerCompanyID:  "GLOBEX",
+		Currency:        "USD",
+		IssueDate:       "2018-06-01",
+		DueDate:         "2018-07-01",
+		LineItems:       []qbchain.LineItem{{Description: "Widgets", Quantity: 1, UnitPrice: 1000}},
+	}
+	tx, err := qbchain.NewInvoiceTransaction(issuer.Public, qbchain.GenerateNewKeypair().Public, inv)
+	require.NoError(t, err)
+	tx.Header.Timestamp = timestamp
+	tx.Header.Nonce = tx.GenerateNonce(qbchain.TRANSACTION_POW)
+	tx.Signature = tx.Sign(issuer)
+	return tx
+}
+
+func TestPoolAdd(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDB(t)
+	defer cleanup()
+	pool := New(db, 10, 10)
+
+	issuer := qbchain.GenerateNewKeypair()
+	second := makeInvoice(t, issuer, "INV-2", 2000)
+	first := makeInvoice(t, issuer, "INV-1", 1000)
+	require.NoError(pool.Add(second))
+	require.NoError(pool.Add(first))
+
+	// Duplicates and replays are rejected
+	require.Equal(qbchain.ErrAlreadyPending, pool.Add(first))
+	require.True(pool.Has(first.Hash()))
+	require.IsType(&qbchain.ConflictError{}, pool.Add(makeInvoice(t, issuer, "INV-1", 3000)))
+	// Transactions of the same second are kept in the order they arrived
+	require.NoError(pool.Add(makeInvoice(t, issuer, "INV-3", 1000)))
+
+	forged := makeInvoice(t, issuer, "INV-3", 3000)
+	forged.Signature = forged.Sign(qbchain.GenerateNewKeypair())
+	require.Error(pool.Add(forged))
+
+	// Transactions of an account are taken in timestamp order
+	require.Equal([]string{string(issuer.Public)}, pool.Accounts())
+	txns := pool.Take(string(issuer.Public), 10)
+	require.Len(txns, 3)
+	require.Equal("INV-1", txns[0].Header.TransactionID)
+	require.Equal("INV-3", txns[1].Header.TransactionID)
+	require.Equal("INV-2", txns[2].Header.TransactionID)
+	require.Equal(0, pool.Len())
+	require.Empty(pool.Accounts())
+	require.False(pool.Has(first.Hash()))
+}
+
+func TestPoolLimits(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDB(t)
+	defer cleanup()
+	pool := New(db, 3, 3)
+
+	busy := qbchain.GenerateNewKeypair()
+	require.NoError(pool.Add(makeInvoice(t, busy, "INV-1", 1000)))
+	require.NoError(pool.Add(makeInvoice(t, busy, "INV-2", 2000)))
+	require.NoError(pool.Add(makeInvoice(t, busy, "INV-3", 3000)))
+	require.Error(pool.Add(makeInvoice(t, busy, "INV-4", 4000)))
+
+	// The latest transaction of the busiest account makes room
+	quiet := qbchain.GenerateNewKeypair()
+	require.NoError(pool.Add(makeInvoice(t, quiet, "INV-1", 1000)))
+	require.Equal(3, pool.Len())
+	pending := pool.Pending(string(busy.Public))
+	require.Len(pending, 2)
+	require.Equal("INV-2", pending[1].Transaction.Header.TransactionID)
+
+	// Unless it has no more pending transactions than the new one's account
+	require.Equal(qbchain.ErrMempoolFull, pool.Add(makeInvoice(t, quiet, "INV-2", 2000)))
+}
@@ -0,0 +1,122 @@
+package qbchain
+
+import (
+	"bytes"
+
+	"github.com/izqui/helpers"
+)
+
+func merkleLeaf(h []byte, version uint8) []byte {
+	if version < MERKLE_TREE_VERSION {
+		return h
+	}
+	return helpers.SHA256(append([]byte{0x00}, h...))
+}
+
+func merkleParent(left, right []byte, version uint8) []byte {
+	node := append(append([]byte{}, left...), right...)
+	if version < MERKLE_TREE_VERSION {
+		return helpers.SHA256(node)
+	}
+	return helpers.SHA256(append([]byte{0x01}, node...))
+}
+
+// merkleLevels builds the Merkle tree of a block header version over the
+// given transaction hashes bottom up. The first level is the leaves, the
+// last level holds the root.
+func merkleLevels(hashes [][]byte, version uint8) [][][]byte {
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	leaves := make([][]byte, len(hashes))
+	for i := range hashes {
+		leaves[i] = merkleLeaf(hashes[i], version)
+	}
+
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleParent(level[i], level[i+1], version))
+			} else if version < MERKLE_TREE_VERSION {
+				next = append(next, merkleParent(level[i], level[i], version))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+func (slice TransactionSlice) hashes() [][]byte {
+	hashes := make([][]byte, len(slice))
+	for i := range slice {
+		hashes[i] = slice[i].Hash()
+	}
+	return hashes
+}
+
+// MerkleRoot returns the root of the Merkle tree over the transaction
+// hashes, or nil for an empty slice.
+func (slice TransactionSlice) MerkleRoot() []byte {
+	return slice.merkleRoot(BLOCK_HEADER_VERSION)
+}
+
+func (slice TransactionSlice) merkleRoot(version uint8) []byte {
+	levels := merkleLevels(slice.hashes(), version)
+	if levels == nil {
+		return nil
+	}
+	return levels[len(levels)-1][0]
+}
+
+// MerkleStep is one sibling hash on the path from a leaf to the root.
+// Left tells whether the sibling is the left operand of the parent hash.
+type MerkleStep struct {
+	Hash []byte `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// MerkleProof returns the sibling hashes that link transaction i to the
+// Merkle root of the slice.
+func (slice TransactionSlice) MerkleProof(i int) []MerkleStep {
+	return slice.merkleProof(i, BLOCK_HEADER_VERSION)
+}
+
+func (slice TransactionSlice) merkleProof(i int, version uint8) []MerkleStep {
+	levels := merkleLevels(slice.hashes(), version)
+	steps := make([]MerkleStep, 0, len(levels))
+	for _, level := range levels[:len(levels)-1] {
+		if i%2 == 1 {
+			steps = append(steps, MerkleStep{level[i-1], true})
+		} else if i+1 < len(level) {
+			steps = append(steps, MerkleStep{level[i+1], false})
+		} else if version < MERKLE_TREE_VERSION {
+			steps = append(steps, MerkleStep{level[i], false})
+		}
+		i /= 2
+	}
+	return steps
+}
+
+// VerifyMerkleProof checks that the transaction hash and the proof hash up
+// to root.
+func VerifyMerkleProof(hash []byte, steps []MerkleStep, root []byte) bool {
+	return verifyMerkleProof(hash, steps, root, BLOCK_HEADER_VERSION)
+}
+
+func verifyMerkleProof(hash []byte, steps []MerkleStep, root []byte, version uint8) bool {
+	h := merkleLeaf(hash, version)
+	for _, step := range steps {
+		if step.Left {
+			h = merkleParent(step.Hash, h, version)
+		} else {
+			h = merkleParent(h, step.Hash, version)
+		}
+	}
+	return bytes.Equal(h, root)
+}
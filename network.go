@@ -1,45 +1,345 @@
 package qbchain
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"strconv"
+	"sync"
+	"time"
+
+	"github.com/izqui/helpers"
 )
 
-func SendUDP(data []byte, udpServer string) error {
-	conn, err := net.Dial("udp", udpServer)
+// Peers exchange framed messages over TCP. Every frame starts with a
+// MESSAGE_TYPE_SIZE type byte and MESSAGE_OPTIONS_SIZE bytes of options,
+// which hold the little endian length of the body that follows. The body is
+// signed by the node that sent it: it holds the length and bytes of the
+// sender's public key, then those of its signature of the type and payload,
+// then the payload.
+//
+// Only MESSAGE_PING is answered to any node, so that peers can learn each
+// other's key. Other messages are refused unless they are signed with the
+// key of a registered peer, see PeerRegistry.Known.
+//
+// A MESSAGE_BLOCK carries a block in its binary encoding and is answered by
+// MESSAGE_ACK once the block is stored, or MESSAGE_NACK with the reason it
+// was refused.
+
+// nodeKeypair signs the messages this node sends to its peers.
+var nodeKeypair = GenerateNewKeypair()
+
+// SetNodeKeypair makes kp the identity of the node towards its peers. It
+// must be called before the node talks to any of them.
+func SetNodeKeypair(kp *Keypair) {
+	nodeKeypair = kp
+}
+
+func messageHash(msgType byte, payload []byte) []byte {
+	return helpers.SHA256(append([]byte{msgType}, payload...))
+}
+
+func writeMessage(w io.Writer, msgType byte, payload []byte) error {
+	sig, err := nodeKeypair.Sign(messageHash(msgType, payload))
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
-	defer conn.Close()
-	conn.Write([]byte("Hello from client"))
+
+	body := make([]byte, 0, 2+len(nodeKeypair.Public)+len(sig)+len(payload))
+	for _, field := range [][]byte{nodeKeypair.Public, sig} {
+		if len(field) > 255 {
+			return errors.New("public key or signature is too long")
+		}
+		body = append(append(body, byte(len(field))), field...)
+	}
+	body = append(body, payload...)
+	if len(body) > MAX_MESSAGE_SIZE {
+		return fmt.Errorf("message of %d bytes exceeds the maximum size", len(body))
+	}
+
+	header := make([]byte, MESSAGE_TYPE_SIZE+MESSAGE_OPTIONS_SIZE)
+	header[0] = msgType
+	binary.LittleEndian.PutUint32(header[MESSAGE_TYPE_SIZE:], uint32(len(body)))
+
+	if _, err := w.Write(append(header, body...)); err != nil {
+		return err
+	}
 	return nil
 }
 
-// listen to incoming udp packets
-func ListenUDP(port int) {
-	/* Lets prepare a address at any address at port 10001*/
-	ServerAddr, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(port))
-	CheckError(err)
+// readMessage reads a frame and returns its type, its payload and the public
+// key of the node that signed it.
+func readMessage(r io.Reader) (byte, []byte, []byte, error) {
+	header := make([]byte, MESSAGE_TYPE_SIZE+MESSAGE_OPTIONS_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[MESSAGE_TYPE_SIZE:])
+	if length > MAX_MESSAGE_SIZE {
+		return 0, nil, nil, fmt.Errorf("message of %d bytes exceeds the maximum size", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, nil, err
+	}
+
+	var fields [2][]byte
+	for i := range fields {
+		if len(body) == 0 || len(body) < 1+int(body[0]) {
+			return 0, nil, nil, errors.New("message is not signed")
+		}
+		fields[i], body = body[1:1+int(body[0])], body[1+int(body[0]):]
+	}
+	from, sig := fields[0], fields[1]
+	if !SignatureVerify(from, sig, messageHash(header[0], body)) {
+		return 0, nil, nil, errors.New("invalid message signature")
+	}
+	return header[0], body, from, nil
+}
 
-	/* Now listen at selected port */
-	ServerConn, err := net.ListenUDP("udp", ServerAddr)
+// request sends a message to a peer and returns its reply, along with the
+// public key of the peer.
+func request(peer string, msgType byte, payload []byte) (byte, []byte, []byte, error) {
+	conn, err := net.DialTimeout("tcp", peer, PEER_TIMEOUT)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(PEER_TIMEOUT))
+
+	if err := writeMessage(conn, msgType, payload); err != nil {
+		return 0, nil, nil, err
+	}
+	return readMessage(conn)
+}
+
+// SendBlock sends a block to a peer and waits for it to be acknowledged.
+func SendBlock(peer string, b Block) error {
+	payload, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	msgType, reply, _, err := request(peer, MESSAGE_BLOCK, payload)
+	if err != nil {
+		return err
+	}
+	switch msgType {
+	case MESSAGE_ACK:
+		return nil
+	case MESSAGE_NACK:
+		return fmt.Errorf("peer %s refused block: %s", peer, reply)
+	default:
+		return fmt.Errorf("unexpected reply of type %d from peer %s", msgType, peer)
+	}
+}
+
+// Ping checks that a peer is reachable and answering, and returns its public
+// key.
+func Ping(peer string) ([]byte, error) {
+	msgType, _, from, err := request(peer, MESSAGE_PING, nil)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != MESSAGE_PONG {
+		return nil, fmt.Errorf("unexpected reply of type %d from peer %s", msgType, peer)
+	}
+	return from, nil
+}
+
+// replicate sends the block to a peer, retrying with exponential backoff.
+func replicate(peer string, b Block) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := SendBlock(peer, b)
+		if err == nil {
+			log.Printf("Block %x replicated to %s", b.BlockHash, peer)
+			return
+		}
+		if attempt == REPLICATION_RETRIES {
+			log.Printf("Giving up replicating block %x to %s: %v", b.BlockHash, peer, err)
+			return
+		}
+		log.Printf("Failed to replicate block %x to %s (attempt %d): %v", b.BlockHash, peer, attempt, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// ListenPeers accepts connections from other nodes on the given port and
+// stores the blocks they replicate.
+func ListenPeers(port int, db *DB) {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 	CheckError(err)
-	log.Println("UDP Server is listening at port " + strconv.Itoa(port) + "...")
-	defer ServerConn.Close()
+	log.Println("P2P Server is listening at port " + strconv.Itoa(port) + "...")
+
+	ServePeers(l, db)
+}
 
-	buf := make([]byte, 1024)
+func ServePeers(l net.Listener, db *DB) {
+	defer l.Close()
 
 	for {
-		n, addr, err := ServerConn.ReadFromUDP(buf)
-		log.Println("Received ", string(buf[0:n]), " from ", addr)
-
+		conn, err := l.Accept()
 		if err != nil {
 			log.Println("Error: ", err)
+			return
+		}
+		go handlePeer(conn, db)
+	}
+}
+
+func handlePeer(conn net.Conn, db *DB) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	peers := NewPeerRegistry(db)
+
+	for {
+		conn.SetDeadline(time.Now().Add(PEER_TIMEOUT))
+		msgType, payload, from, err := readMessage(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if msgType != MESSAGE_PING && !peers.Known(from) {
+			log.Printf("Refused message of type %d from %s signed by unknown key %s", msgType, conn.RemoteAddr(), from)
+			if err := writeMessage(conn, MESSAGE_NACK, []byte("not signed by a registered peer")); err != nil {
+				log.Printf("Error writing to %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		switch msgType {
+		case MESSAGE_BLOCK:
+			var b Block
+			err = b.UnmarshalBinary(payload)
+			if err == nil {
+				err = storeReplicatedBlock(db, &b)
+			}
+			if err != nil {
+				log.Printf("Refused block from %s: %v", conn.RemoteAddr(), err)
+				err = writeMessage(conn, MESSAGE_NACK, []byte(err.Error()))
+			} else {
+				err = writeMessage(conn, MESSAGE_ACK, b.BlockHash)
+			}
+		case MESSAGE_PING:
+			err = writeMessage(conn, MESSAGE_PONG, nil)
+		case MESSAGE_GET_HEADS:
+			err = serveHeads(conn, db)
+		case MESSAGE_GET_BLOCKS:
+			err = serveBlocks(conn, db, payload)
+		default:
+			err = writeMessage(conn, MESSAGE_NACK, []byte(fmt.Sprintf("unknown message type %d", msgType)))
+		}
+		if err != nil {
+			log.Printf("Error writing to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// replicationMu serialises writes of blocks received from peers, which may
+// arrive for the same chain on several connections at once.
+var replicationMu sync.Mutex
+
+// storeReplicatedBlock verifies a block received from a peer and appends it
+// to its account chain. Blocks that are already stored are accepted again so
+// that retries are harmless. A block that conflicts with the chain is
+// quarantined and a *ForkError is returned.
+func storeReplicatedBlock(db *DB, b *Block) error {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	if b.BlockHeader == nil || b.TransactionSlice == nil || len(*b.TransactionSlice) == 0 {
+		return errors.New("block has no transactions")
+	}
+	b.BlockHash = b.Hash()
+
+	if err := b.verifyMerkleRoot(); err != nil {
+		return err
+	}
+
+	owner := b.Owner()
+	for _, t := range *b.TransactionSlice {
+		if !bytes.Equal(t.Header.From, owner) {
+			return errors.New("block holds transactions of more than one account")
+		}
+	}
+	if !b.VerifyBlock(BLOCK_POW) {
+		return errors.New("invalid proof of work, transaction or signature")
+	}
+	if !b.IsMirror() {
+		if b.BlockHeader.Version < BLOCK_SIGNER_VERSION {
+			return errors.New("block does not name the node that forged it")
+		}
+		if !bytes.Equal(b.Signer, nodeKeypair.Public) && !NewPeerRegistry(db).Known(b.Signer) {
+			return fmt.Errorf("block is forged by %s, which is not a registered peer", b.Signer)
+		}
+	}
+
+	bc := NewBlockchain(string(owner), db)
+	for _, stored := range bc.chain {
+		if bytes.Equal(stored.BlockHash, b.BlockHash) {
+			return nil
+		}
+	}
+	if !sameHash(b.BlockHeader.PrevBlock, bc.latest) {
+		return quarantine(db, bc, string(owner), b)
+	}
+	if err := verifyReplicated(db, bc, b); err != nil {
+		return err
+	}
+
+	if err := bc.AddBlock(*b, db); err != nil {
+		return err
+	}
+	log.Printf("Replicated block %x added to the chain of %s", b.BlockHash, owner)
+	return nil
+}
+
+// verifyReplicated checks the transactions of a block received from a peer
+// against the chain it extends, the way forgeBlock checks the transactions
+// of a block of this node: a transaction cannot be forged twice, nor its
+// TransactionID reused, and it must be legal in the lifecycle of its
+// invoice. A receiver block cannot accept a sender block twice.
+func verifyReplicated(db *DB, bc *Blockchain, b *Block) error {
+	if b.IsMirror() {
+		for _, stored := range bc.chain {
+			if bytes.Equal(stored.BlockHeader.Origin, b.BlockHeader.Origin) {
+				return fmt.Errorf("sender block %x is already accepted", b.BlockHeader.Origin)
+			}
+		}
+		for _, t := range b.AuthoredTransactions() {
+			if bc.HasTransaction(t.Hash()) {
+				return fmt.Errorf("transaction %s is already in the chain", t.Header.TransactionID)
+			}
+		}
+		return nil
+	}
+
+	statuses := make(map[string]*InvoiceStatus)
+	ids := make(map[string]bool)
+	for i := range *b.TransactionSlice {
+		t := &(*b.TransactionSlice)[i]
+		if id := t.Header.TransactionID; id != "" && ids[id] {
+			return &ConflictError{TransactionID: id}
+		}
+		ids[t.Header.TransactionID] = true
+		if err := verifyForging(db, bc, t, statuses); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 /* A Simple function to verify error */
@@ -0,0 +1,233 @@
+package qbchain
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// makeTestSenderBlock forges a block of the issuer holding an invoice
+// numbered after the timestamp, without storing it.
+func makeTestSenderBlock(kp *Keypair, prev []byte, timestamp uint32) Block {
+	inv := makeTestInvoice()
+	inv.Number = fmt.Sprintf("INV-%d", timestamp)
+	t, _ := NewInvoiceTransaction(kp.Public, GenerateNewKeypair().Public, inv)
+	t.Header.Timestamp = timestamp
+	t.Header.Nonce = t.GenerateNonce(TRANSACTION_POW)
+	t.Signature = t.Sign(kp)
+	return makeTestBlock(prev, t)
+}
+
+// makeTestBlock forges a sender block of the given transactions.
+func makeTestBlock(prev []byte, txns ...Transaction) Block {
+	block := NewBlock(prev)
+	for i := range txns {
+		block.AddTransaction(&txns[i])
+		block.BlockHeader.Timestamp = txns[i].Header.Timestamp
+	}
+	block.BlockHeader.Nonce = block.GenerateNonce(BLOCK_POW)
+	block.Signature = block.Sign(nodeKeypair)
+	block.Signer = nodeKeypair.Public
+	block.BlockHash = block.Hash()
+	return block
+}
+
+func TestReplication(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go ServePeers(l, db)
+	peer := l.Addr().String()
+
+	kp := GenerateNewKeypair()
+	first := makeTestSenderBlock(kp, nil, 1000)
+	// Blocks are only taken from registered peers
+	require.Error(SendBlock(peer, first))
+	trustPeer(t, db, nodeKeypair.Public)
+	require.NoError(SendBlock(peer, first))
+	// Retries of a stored block are acknowledged
+	require.NoError(SendBlock(peer, first))
+
+	second := makeTestSenderBlock(kp, first.BlockHash, 1001)
+	require.NoError(SendBlock(peer, second))
+
+	bc := NewBlockchain(string(kp.Public), db)
+	require.Len(bc.chain, 2)
+	require.Equal(second.BlockHash, bc.latest)
+
+	// Does not follow the latest block of the chain
+	require.Error(SendBlock(peer, makeTestSenderBlock(kp, bytes.Repeat([]byte{1}, 32), 1002)))
+
+	tampered := makeTestSenderBlock(kp, second.BlockHash, 1003)
+	(*tampered.TransactionSlice)[0].Header.Amount = 1
+	require.Error(SendBlock(peer, tampered))
+
+	// Not signed by the node it names
+	forged := makeTestSenderBlock(kp, second.BlockHash, 1004)
+	forged.Signature = forged.Sign(GenerateNewKeypair())
+	require.Error(SendBlock(peer, forged))
+
+	// Forged by a node that is not a registered peer
+	stranger := GenerateNewKeypair()
+	forged.Signature, forged.Signer = forged.Sign(stranger), stranger.Public
+	require.Error(SendBlock(peer, forged))
+
+	// Not naming the node that forged it
+	unnamed := makeTestSenderBlock(kp, second.BlockHash, 1005)
+	unnamed.BlockHeader.Version = BLOCK_SIGNER_VERSION - 1
+	unnamed.BlockHeader.Nonce = unnamed.GenerateNonce(BLOCK_POW)
+	unnamed.Signature = unnamed.Sign(nodeKeypair)
+	require.Error(SendBlock(peer, unnamed))
+
+	require.Len(NewBlockchain(string(kp.Public), db).chain, 2)
+}
+
+// trustPeer registers a peer with the given key in db, as if it had been
+// probed.
+func trustPeer(t *testing.T, db *DB, key []byte) {
+	address := fmt.Sprintf("127.0.0.1:%d", 10000+len(key))
+	peers := NewPeerRegistry(db)
+	_, err := peers.Add(address)
+	require.NoError(t, err)
+	peers.record(address, key, nil)
+}
+
+// A peer cannot replay transactions that are already forged in new blocks
+func TestReplicationReplay(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	issuer := GenerateNewKeypair()
+	buyer := GenerateNewKeypair()
+	invoice := makeTestInvoiceTransaction(t, issuer, buyer.Public)
+	first := makeTestBlock(nil, invoice)
+	require.NoError(storeReplicatedBlock(db, &first))
+
+	// The same transaction in a new head block
+	replay := makeTestBlock(first.BlockHash, invoice)
+	require.Error(storeReplicatedBlock(db, &replay))
+
+	// Another transaction of the sender with the same ID
+	other := invoice
+	other.Header.Timestamp++
+	other.Header.Nonce = other.GenerateNonce(TRANSACTION_POW)
+	other.Signature = other.Sign(issuer)
+	reused := makeTestBlock(first.BlockHash, other)
+	require.IsType(&ConflictError{}, storeReplicatedBlock(db, &reused))
+
+	// The same ID twice in one block
+	inv := makeTestInvoice()
+	inv.Number = "INV-0002"
+	second, err := NewInvoiceTransaction(issuer.Public, buyer.Public, inv)
+	require.NoError(err)
+	second.Header.Nonce = second.GenerateNonce(TRANSACTION_POW)
+	second.Signature = second.Sign(issuer)
+	twice := second
+	twice.Header.Amount--
+	twice.Header.Nonce = twice.GenerateNonce(TRANSACTION_POW)
+	twice.Signature = twice.Sign(issuer)
+	doubled := makeTestBlock(first.BlockHash, second, twice)
+	require.IsType(&ConflictError{}, storeReplicatedBlock(db, &doubled))
+
+	// A follow-up that is illegal in the lifecycle of its invoice
+	payment := NewFollowUpTransaction(buyer.Public, issuer.Public, KindPayment, "INV-0001", "PAY-1", invoice.Header.Amount+1, "USD", nil)
+	payment.Header.Nonce = payment.GenerateNonce(TRANSACTION_POW)
+	payment.Signature = payment.Sign(buyer)
+	overpaid := makeTestBlock(nil, payment)
+	require.Error(storeReplicatedBlock(db, &overpaid))
+
+	// Without a proof of work
+	unmined := makeTestBlock(first.BlockHash, second)
+	for CheckProofOfWork(BLOCK_POW, unmined.Hash()) {
+		unmined.BlockHeader.Nonce++
+	}
+	unmined.Signature = unmined.Sign(nodeKeypair)
+	require.Error(storeReplicatedBlock(db, &unmined))
+
+	require.Len(NewBlockchain(string(issuer.Public), db).chain, 1)
+
+	// An acceptance cannot be replayed in a new receiver block
+	rblocks := receiverBlocks(&first)
+	accepted := rblocks[0]
+	accepted.Signature, _ = buyer.Sign(accepted.BlockHeader.Origin)
+	accepted.BlockHash = accepted.Hash()
+	require.NoError(storeReplicatedBlock(db, &accepted))
+	again := accepted
+	again.BlockHeader = &BlockHeader{}
+	*again.BlockHeader = *accepted.BlockHeader
+	again.BlockHeader.PrevBlock = accepted.BlockHash
+	again.BlockHash = again.Hash()
+	require.Error(storeReplicatedBlock(db, &again))
+	require.Len(NewBlockchain(string(buyer.Public), db).chain, 1)
+}
+
+func TestSyncPeer(t *testing.T) {
+	require := require.New(t)
+	online, cleanupOnline := makeDBTest(t)
+	defer cleanupOnline()
+	offline, cleanupOffline := makeDBTest(t)
+	defer cleanupOffline()
+
+	kp := GenerateNewKeypair()
+	var prev []byte
+	for i := 0; i < 3; i++ {
+		b := makeTestSenderBlock(kp, prev, uint32(1000+i))
+		require.NoError(storeReplicatedBlock(online, &b))
+		if i == 0 {
+			require.NoError(storeReplicatedBlock(offline, &b))
+		}
+		prev = b.BlockHash
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go ServePeers(l, online)
+	peer := l.Addr().String()
+	trustPeer(t, online, nodeKeypair.Public)
+
+	syncer := NewSyncer(offline)
+	require.NoError(syncer.SyncPeer(peer))
+
+	bc := NewBlockchain(string(kp.Public), offline)
+	require.Len(bc.chain, 3)
+	require.Equal(prev, bc.latest)
+
+	status := syncer.Status()
+	require.Len(status, 1)
+	require.Equal(peer, status[0].Peer)
+	require.Equal(1, status[0].Behind)
+	require.Equal(2, status[0].Pulled)
+	require.Equal(0, status[0].Lag)
+	require.Empty(status[0].Error)
+
+	// Nothing left to pull
+	require.NoError(syncer.SyncPeer(peer))
+	require.Equal(0, syncer.Status()[0].Pulled)
+}
+
+func TestSignedMessages(t *testing.T) {
+	require := require.New(t)
+
+	var buf bytes.Buffer
+	require.NoError(writeMessage(&buf, MESSAGE_PING, []byte("payload")))
+	frame := buf.Bytes()
+
+	msgType, payload, from, err := readMessage(bytes.NewReader(frame))
+	require.NoError(err)
+	require.Equal(byte(MESSAGE_PING), msgType)
+	require.Equal([]byte("payload"), payload)
+	require.Equal(nodeKeypair.Public, from)
+
+	// A payload changed on the way is refused
+	tampered := append([]byte{}, frame...)
+	tampered[len(tampered)-1] ^= 1
+	_, _, _, err = readMessage(bytes.NewReader(tampered))
+	require.Error(err)
+}
@@ -0,0 +1,196 @@
+package qbchain
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Peer is another node of the cluster, reached at the address of its P2P
+// listener. A peer that fails a liveness probe is not probed again until
+// NextProbe, which backs off exponentially with the number of failures.
+type Peer struct {
+	Address   string    `json:"address"`
+	AddedAt   time.Time `json:"added_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Failures  int       `json:"failures"`
+	NextProbe time.Time `json:"next_probe"`
+	LastError string    `json:"last_error,omitempty"`
+	PublicKey string    `json:"public_key,omitempty"`
+}
+
+func (p *Peer) Alive() bool {
+	return p.Failures == 0
+}
+
+// PeerRegistry keeps the cluster membership in the store so that it survives
+// restarts.
+type PeerRegistry struct {
+	db *DB
+	mu sync.Mutex
+}
+
+func NewPeerRegistry(db *DB) *PeerRegistry {
+	return &PeerRegistry{db: db}
+}
+
+// peerAddress accepts a host:port, or a URL whose host is used.
+func peerAddress(address string) (string, error) {
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return "", err
+		}
+		address = u.Host
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", err
+	}
+	return address, nil
+}
+
+// Add registers a peer. It returns false if the peer was already registered.
+func (r *PeerRegistry) Add(address string) (bool, error) {
+	address, err := peerAddress(address)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.db.getPeer(address, []byte(DB_PEERS_NAMESPACE)); err == nil {
+		return false, nil
+	}
+	now := time.Now()
+	log.Printf("Peer %s registered", address)
+	return true, r.db.setPeer(&Peer{Address: address, AddedAt: now, NextProbe: now}, []byte(DB_PEERS_NAMESPACE))
+}
+
+func (r *PeerRegistry) Remove(address string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.db.getPeer(address, []byte(DB_PEERS_NAMESPACE)); err != nil {
+		return errors.New("peer " + address + " is not registered")
+	}
+	log.Printf("Peer %s removed", address)
+	return r.db.deletePeer(address, []byte(DB_PEERS_NAMESPACE))
+}
+
+// List returns every registered peer ordered by address.
+func (r *PeerRegistry) List() ([]Peer, error) {
+	peers, err := r.db.getPeers([]byte(DB_PEERS_NAMESPACE))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	return peers, nil
+}
+
+// Addresses returns the addresses of the peers that passed their last probe.
+func (r *PeerRegistry) Addresses() []string {
+	peers, err := r.List()
+	if err != nil {
+		log.Printf("Failed to list peers: %v", err)
+		return nil
+	}
+
+	addresses := make([]string, 0, len(peers))
+	for i := range peers {
+		if peers[i].Alive() {
+			addresses = append(addresses, peers[i].Address)
+		}
+	}
+	return addresses
+}
+
+// Known tells whether key is the public key of a registered peer.
+func (r *PeerRegistry) Known(key []byte) bool {
+	if len(key) == 0 {
+		return false
+	}
+	peers, err := r.List()
+	if err != nil {
+		log.Printf("Failed to list peers: %v", err)
+		return false
+	}
+	for i := range peers {
+		if peers[i].PublicKey == string(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Probe pings every peer that is due and records the outcome.
+func (r *PeerRegistry) Probe() {
+	peers, err := r.List()
+	if err != nil {
+		log.Printf("Failed to list peers: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for i := range peers {
+		if now.Before(peers[i].NextProbe) {
+			continue
+		}
+		key, err := Ping(peers[i].Address)
+		r.record(peers[i].Address, key, err)
+	}
+}
+
+// Run probes the peers every interval.
+func (r *PeerRegistry) Run(interval time.Duration) {
+	for {
+		r.Probe()
+		time.Sleep(interval)
+	}
+}
+
+func (r *PeerRegistry) record(address string, key []byte, probeErr error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The peer may have been removed while it was probed
+	p, err := r.db.getPeer(address, []byte(DB_PEERS_NAMESPACE))
+	if err != nil {
+		return
+	}
+
+	// The key learned on the first probe is pinned: a peer answering with
+	// another one fails the probe, and must be removed and added again if
+	// its key really changed
+	if probeErr == nil && p.PublicKey != "" && p.PublicKey != string(key) {
+		probeErr = fmt.Errorf("peer answered with key %s instead of %s", key, p.PublicKey)
+	}
+
+	now := time.Now()
+	if probeErr == nil {
+		if !p.Alive() {
+			log.Printf("Peer %s is back after %d failed probes", address, p.Failures)
+		}
+		p.LastSeen, p.Failures, p.LastError, p.PublicKey = now, 0, "", string(key)
+		p.NextProbe = now.Add(PEER_PROBE_INTERVAL)
+	} else {
+		p.Failures++
+		p.LastError = probeErr.Error()
+		backoff := PEER_PROBE_INTERVAL << uint(p.Failures-1)
+		if backoff > PEER_MAX_BACKOFF || backoff <= 0 {
+			backoff = PEER_MAX_BACKOFF
+		}
+		p.NextProbe = now.Add(backoff)
+		log.Printf("Peer %s failed probe %d, next probe in %s: %v", address, p.Failures, backoff, probeErr)
+	}
+
+	if err := r.db.setPeer(&p, []byte(DB_PEERS_NAMESPACE)); err != nil {
+		log.Printf("Failed to save peer %s: %v", address, err)
+	}
+}
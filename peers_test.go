@@ -0,0 +1,76 @@
+package qbchain
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerRegistry(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go ServePeers(l, db)
+	up := l.Addr().String()
+
+	// Nothing listens on a closed listener's port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	down := closed.Addr().String()
+	closed.Close()
+
+	peers := NewPeerRegistry(db)
+	added, err := peers.Add("http://" + up)
+	require.NoError(err)
+	require.True(added)
+	added, err = peers.Add(up)
+	require.NoError(err)
+	require.False(added)
+	_, err = peers.Add(down)
+	require.NoError(err)
+	_, err = peers.Add("not a peer")
+	require.Error(err)
+
+	peers.Probe()
+
+	// Registered peers are kept in the store
+	list, err := NewPeerRegistry(db).List()
+	require.NoError(err)
+	require.Len(list, 2)
+	for _, p := range list {
+		if p.Address == up {
+			require.True(p.Alive())
+			require.False(p.LastSeen.IsZero())
+		} else {
+			require.Equal(1, p.Failures)
+			require.NotEmpty(p.LastError)
+			require.True(p.NextProbe.After(time.Now()))
+		}
+	}
+	require.Equal([]string{up}, peers.Addresses())
+
+	// Failing peers back off until their next probe is due
+	peers.Probe()
+	failing, err := db.getPeer(down, []byte(DB_PEERS_NAMESPACE))
+	require.NoError(err)
+	require.Equal(1, failing.Failures)
+
+	// The key of a peer is pinned on its first probe
+	require.True(peers.Known(nodeKeypair.Public))
+	peers.record(up, GenerateNewKeypair().Public, nil)
+	pinned, err := db.getPeer(up, []byte(DB_PEERS_NAMESPACE))
+	require.NoError(err)
+	require.Equal(string(nodeKeypair.Public), pinned.PublicKey)
+	require.Equal(1, pinned.Failures)
+
+	require.NoError(peers.Remove(down))
+	require.Error(peers.Remove(down))
+	list, err = peers.List()
+	require.NoError(err)
+	require.Len(list, 1)
+}
@@ -0,0 +1,68 @@
+package qbchain
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// ErrMempoolFull is returned by a Mempool that cannot make room for a
+// transaction.
+var ErrMempoolFull = errors.New("mempool is full")
+
+// Mempool holds the transactions a node accepted until they are forged into
+// blocks. Add returns ErrAlreadyPending for a transaction it holds already
+// and a *ConflictError for another one with a pending TransactionID. Take
+// returns the oldest transactions of an account, in the order they have to
+// be forged, and removes them.
+type Mempool interface {
+	Add(t Transaction) error
+	Has(hash []byte) bool
+	Accounts() []string
+	Take(account string, max int) []Transaction
+}
+
+// Producer drains the pending transactions of every account into blocks of
+// at most maxBlockSize transactions, signed by the node, and replicates them
+// to the peers.
+type Producer struct {
+	db           *DB
+	pool         Mempool
+	peers        *PeerRegistry
+	keypair      *Keypair
+	maxBlockSize int
+}
+
+func NewProducer(db *DB, pool Mempool, peers *PeerRegistry, keypair *Keypair, maxBlockSize int) *Producer {
+	return &Producer{db, pool, peers, keypair, maxBlockSize}
+}
+
+// Produce forges the pending transactions of every account and returns the
+// blocks it forged. A transaction that no longer applies, e.g. one paying an
+// invoice that was voided since it was accepted, is dropped.
+func (p *Producer) Produce() []Block {
+	var blocks []Block
+	for _, account := range p.pool.Accounts() {
+		for txns := p.pool.Take(account, p.maxBlockSize); len(txns) > 0; txns = p.pool.Take(account, p.maxBlockSize) {
+			block, _, err := forgeBlock(p.db, txns, p.keypair)
+			if err != nil {
+				log.Printf("Failed to forge a block of %s: %v", account, err)
+				continue
+			}
+			blocks = append(blocks, block)
+			if p.peers != nil {
+				sendToPeers(p.peers, block)
+			}
+		}
+	}
+	return blocks
+}
+
+// Run produces blocks every interval.
+func (p *Producer) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if blocks := p.Produce(); len(blocks) > 0 {
+			log.Printf("Forged %d blocks from the mempool", len(blocks))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package qbchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testMempool holds the transactions of a single account.
+type testMempool struct {
+	account string
+	txns    []Transaction
+}
+
+func (m *testMempool) Add(t Transaction) error {
+	m.txns = append(m.txns, t)
+	return nil
+}
+
+func (m *testMempool) Has(hash []byte) bool {
+	for i := range m.txns {
+		if bytes.Equal(m.txns[i].Hash(), hash) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *testMempool) Accounts() []string {
+	if len(m.txns) == 0 {
+		return nil
+	}
+	return []string{m.account}
+}
+
+func (m *testMempool) Take(account string, max int) []Transaction {
+	if max > len(m.txns) {
+		max = len(m.txns)
+	}
+	txns := m.txns[:max]
+	m.txns = m.txns[max:]
+	return txns
+}
+
+func TestProducerProduce(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	issuer := GenerateNewKeypair()
+	buyer := GenerateNewKeypair().Public
+	sign := func(tx Transaction, timestamp uint32) Transaction {
+		tx.Header.Timestamp = timestamp
+		tx.Header.Nonce = tx.GenerateNonce(TRANSACTION_POW)
+		tx.Signature = tx.Sign(issuer)
+		return tx
+	}
+	invoice := func(number string, timestamp uint32) Transaction {
+		inv := makeTestInvoice()
+		inv.Number = number
+		tx, err := NewInvoiceTransaction(issuer.Public, buyer, inv)
+		require.NoError(err)
+		return sign(tx, timestamp)
+	}
+	void := func(number string, timestamp uint32) Transaction {
+		tx := NewFollowUpTransaction(issuer.Public, buyer, KindVoid, "INV-0001", number, 0, "USD", nil)
+		return sign(tx, timestamp)
+	}
+
+	first := invoice("INV-0001", 1000)
+	pool := &testMempool{account: string(issuer.Public)}
+	pool.Add(first)
+	// Follow-ups are checked against the transactions before them
+	pool.Add(void("VOID-1", 2000))
+	pool.Add(void("VOID-2", 3000))
+	pool.Add(invoice("INV-0002", 4000))
+	// Already forged by the time it is taken
+	pool.Add(first)
+
+	node := GenerateNewKeypair()
+	blocks := NewProducer(db, pool, nil, node, 3).Produce()
+	require.Empty(pool.Accounts())
+	require.Len(blocks, 2)
+	require.Len(*blocks[0].TransactionSlice, 2)
+	require.Len(*blocks[1].TransactionSlice, 1)
+
+	for _, b := range blocks {
+		require.True(CheckProofOfWork(BLOCK_POW, b.BlockHash))
+		require.True(SignatureVerify(node.Public, b.Signature, b.BlockHash))
+		require.True(b.SignedBy(issuer.Public))
+	}
+
+	bc := NewBlockchain(string(issuer.Public), db)
+	require.Len(bc.chain, 2)
+	require.Equal(uint32(4000), bc.LastBlock().BlockHeader.Timestamp)
+
+	// The buyer gets one pending block per sender block
+	pending, err := db.getPendingBlocks(string(buyer), []byte(DB_PENDING_NAMESPACE))
+	require.NoError(err)
+	require.Len(pending, 2)
+}
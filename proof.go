@@ -0,0 +1,78 @@
+package qbchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// InclusionProof shows that a transaction is in an account's chain without
+// the rest of the chain: the Merkle path from the transaction to the root in
+// its block header, followed by the headers of every later block up to Head.
+type InclusionProof struct {
+	Account     string        `json:"account"`
+	Transaction Transaction   `json:"transaction"`
+	Siblings    []MerkleStep  `json:"siblings"`
+	Block       BlockHeader   `json:"block"`
+	Headers     []BlockHeader `json:"headers"`
+	Head        []byte        `json:"head"`
+}
+
+// NewInclusionProof builds the proof for the transaction with the given ID in
+// the account's chain.
+func NewInclusionProof(bc *Blockchain, pk string, transactionID string) (*InclusionProof, error) {
+	for i, b := range bc.chain {
+		if b.BlockHeader == nil || b.TransactionSlice == nil {
+			continue
+		}
+		for j, t := range *b.TransactionSlice {
+			if t.Header.TransactionID != transactionID {
+				continue
+			}
+
+			proof := &InclusionProof{
+				Account:     pk,
+				Transaction: t,
+				Siblings:    b.TransactionSlice.merkleProof(j, b.BlockHeader.Version),
+				Block:       *b.BlockHeader,
+				Headers:     make([]BlockHeader, 0, len(bc.chain)-i-1),
+				Head:        bc.chain.LastBlock().BlockHash,
+			}
+			for _, later := range bc.chain[i+1:] {
+				proof.Headers = append(proof.Headers, *later.BlockHeader)
+			}
+			return proof, nil
+		}
+	}
+
+	return nil, fmt.Errorf("transaction %s not found in chain of %s", transactionID, pk)
+}
+
+// Verify checks that the proof is about the transaction transactionID of
+// account, its Merkle path and the chain of header hashes up to Head. The
+// headers come with the proof, so callers must also compare Head with a
+// head hash they obtained independently.
+func (p *InclusionProof) Verify(account, transactionID string) error {
+	if p.Account != account || string(p.Transaction.Header.From) != account {
+		return fmt.Errorf("proof is about a transaction of %s, not of %s", p.Transaction.Header.From, account)
+	}
+	if p.Transaction.Header.TransactionID != transactionID {
+		return fmt.Errorf("proof is about transaction %s, not %s", p.Transaction.Header.TransactionID, transactionID)
+	}
+	if !verifyMerkleProof(p.Transaction.Hash(), p.Siblings, p.Block.MerkleRoot, p.Block.Version) {
+		return errors.New("transaction is not in the block's merkle tree")
+	}
+
+	h := p.Block.Hash()
+	for i := range p.Headers {
+		if !bytes.Equal(p.Headers[i].PrevBlock, h) {
+			return fmt.Errorf("header %d does not link to the previous block %x", i, h)
+		}
+		h = p.Headers[i].Hash()
+	}
+
+	if !bytes.Equal(h, p.Head) {
+		return fmt.Errorf("chain of headers ends at %x, not at head %x", h, p.Head)
+	}
+	return nil
+}
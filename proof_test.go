@@ -0,0 +1,50 @@
+package qbchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerkleProof(t *testing.T) {
+	require := require.New(t)
+
+	var slice TransactionSlice
+	for i := 0; i < 5; i++ {
+		slice = append(slice, NewTransaction([]byte("a"), []byte("b"), int64(i), nil))
+	}
+	root := slice.MerkleRoot()
+
+	for i := range slice {
+		require.True(VerifyMerkleProof(slice[i].Hash(), slice.MerkleProof(i), root))
+	}
+	require.False(VerifyMerkleProof(slice[0].Hash(), slice.MerkleProof(1), root))
+}
+
+func TestInclusionProof(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	kp := GenerateNewKeypair()
+	chain := makeTestChain(t, db, kp, 3)
+	bc := &Blockchain{chain: chain}
+
+	pk := string(kp.Public)
+	proof, err := NewInclusionProof(bc, pk, "INV-0002")
+	require.NoError(err)
+	require.Len(proof.Headers, 1)
+	require.Equal(chain[2].BlockHash, proof.Head)
+	require.NoError(proof.Verify(pk, "INV-0002"))
+
+	// A valid proof of another transaction, or of another account
+	require.Error(proof.Verify(pk, "INV-0001"))
+	require.Error(proof.Verify(string(GenerateNewKeypair().Public), "INV-0002"))
+
+	proof.Transaction.Header.Amount = 1000
+	require.Error(proof.Verify(pk, "INV-0002"))
+
+	_, err = NewInclusionProof(bc, pk, "INV-0004")
+	require.Error(err)
+}
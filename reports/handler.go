@@ -0,0 +1,133 @@
+package reports
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	".."
+)
+
+// NewHandler serves /reports/aging and /reports/balances. Both accept the
+// query parameters company (filter by CompanyID), as_of (YYYY-MM-DD,
+// defaults to today) and format (json or csv).
+func NewHandler(db *qbchain.DB) http.Handler {
+	h := handler{db}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reports/aging", h.Aging)
+	mux.HandleFunc("/reports/balances", h.Balances)
+	return mux
+}
+
+type handler struct {
+	db *qbchain.DB
+}
+
+func (h *handler) Aging(w http.ResponseWriter, r *http.Request) {
+	log.Println("Aging report requested")
+
+	statuses, asOf, ok := h.load(w, r)
+	if !ok {
+		return
+	}
+
+	company := r.URL.Query().Get("company")
+	rows := make([]AgingRow, 0)
+	for _, row := range Aging(statuses, asOf) {
+		if company == "" || row.CompanyID == company {
+			rows = append(rows, row)
+		}
+	}
+
+	if r.URL.Query().Get("format") != "csv" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"as_of": asOf.Format(qbchain.InvoiceDateLayout), "aging": rows})
+		return
+	}
+
+	records := [][]string{{"company_id", "counterparty", "side", "currency", "current", "days_1_30", "days_31_60", "days_61_90", "days_over_90", "total"}}
+	for _, row := range rows {
+		records = append(records, []string{row.CompanyID, row.Counterparty, row.Side, row.Currency,
+			amount(row.Current), amount(row.Days1To30), amount(row.Days31To60), amount(row.Days61To90), amount(row.Over90), amount(row.Total)})
+	}
+	writeCSV(w, records)
+}
+
+func (h *handler) Balances(w http.ResponseWriter, r *http.Request) {
+	log.Println("Balances report requested")
+
+	statuses, asOf, ok := h.load(w, r)
+	if !ok {
+		return
+	}
+
+	company := r.URL.Query().Get("company")
+	rows := make([]BalanceRow, 0)
+	for _, row := range Balances(statuses, asOf) {
+		if company == "" || row.CompanyID == company {
+			rows = append(rows, row)
+		}
+	}
+
+	if r.URL.Query().Get("format") != "csv" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"as_of": asOf.Format(qbchain.InvoiceDateLayout), "balances": rows})
+		return
+	}
+
+	records := [][]string{{"company_id", "currency", "receivable", "payable", "net"}}
+	for _, row := range rows {
+		records = append(records, []string{row.CompanyID, row.Currency, amount(row.Receivable), amount(row.Payable), amount(row.Net)})
+	}
+	writeCSV(w, records)
+}
+
+// load parses the common query parameters and derives the invoice states as
+// of the end of the requested day.
+func (h *handler) load(w http.ResponseWriter, r *http.Request) ([]*qbchain.InvoiceStatus, time.Time, bool) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowd", r.Method))
+		return nil, time.Time{}, false
+	}
+
+	asOf := time.Now().UTC().Truncate(24 * time.Hour)
+	if s := r.URL.Query().Get("as_of"); s != "" {
+		t, err := time.Parse(qbchain.InvoiceDateLayout, s)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, fmt.Sprintf("invalid as_of date %q", s))
+			return nil, time.Time{}, false
+		}
+		asOf = t
+	}
+
+	statuses, err := qbchain.InvoiceStatuses(h.db, asOf.Add(24*time.Hour-time.Second))
+	if err != nil {
+		log.Printf("there was an error when trying to load invoices %v\n", err)
+		writeJSON(w, http.StatusInternalServerError, "fail to load invoices")
+		return nil, time.Time{}, false
+	}
+	return statuses, asOf, true
+}
+
+func amount(a int64) string {
+	return strconv.FormatInt(a, 10)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("could not encode response to output: %v", err)
+	}
+}
+
+func writeCSV(w http.ResponseWriter, records [][]string) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+	if err := csv.NewWriter(w).WriteAll(records); err != nil {
+		log.Printf("could not encode response to output: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+// Package reports computes receivables, payables and aging views over the
+// invoices stored in the ledger.
+package reports
+
+import (
+	"sort"
+	"time"
+
+	".."
+)
+
+const (
+	Receivable = "receivable"
+	Payable    = "payable"
+)
+
+// OutstandingInvoice is an invoice that is neither paid nor voided.
+type OutstandingInvoice struct {
+	InvoiceID   string               `json:"invoice_id"`
+	Currency    string               `json:"currency"`
+	DueDate     string               `json:"due_date"`
+	Total       int64                `json:"total"`
+	Paid        int64                `json:"paid"`
+	Outstanding int64                `json:"outstanding"`
+	DaysPastDue int                  `json:"days_past_due"`
+	State       qbchain.InvoiceState `json:"state"`
+}
+
+// AgingRow sums the outstanding amounts a company is owed by (receivable)
+// or owes to (payable) one counterparty, bucketed by days past due. Current
+// holds the invoices that are not past due yet.
+type AgingRow struct {
+	CompanyID    string               `json:"company_id"`
+	Counterparty string               `json:"counterparty"`
+	Side         string               `json:"side"`
+	Currency     string               `json:"currency"`
+	Current      int64                `json:"current"`
+	Days1To30    int64                `json:"days_1_30"`
+	Days31To60   int64                `json:"days_31_60"`
+	Days61To90   int64                `json:"days_61_90"`
+	Over90       int64                `json:"days_over_90"`
+	Total        int64                `json:"total"`
+	Invoices     []OutstandingInvoice `json:"invoices"`
+}
+
+func (r *AgingRow) add(inv OutstandingInvoice) {
+	switch {
+	case inv.DaysPastDue == 0:
+		r.Current += inv.Outstanding
+	case inv.DaysPastDue <= 30:
+		r.Days1To30 += inv.Outstanding
+	case inv.DaysPastDue <= 60:
+		r.Days31To60 += inv.Outstanding
+	case inv.DaysPastDue <= 90:
+		r.Days61To90 += inv.Outstanding
+	default:
+		r.Over90 += inv.Outstanding
+	}
+	r.Total += inv.Outstanding
+	r.Invoices = append(r.Invoices, inv)
+}
+
+// BalanceRow is the total outstanding receivables and payables of a
+// company in one currency.
+type BalanceRow struct {
+	CompanyID  string `json:"company_id"`
+	Currency   string `json:"currency"`
+	Receivable int64  `json:"receivable"`
+	Payable    int64  `json:"payable"`
+	Net        int64  `json:"net"`
+}
+
+type outstanding struct {
+	issuer, buyer string
+	invoice       OutstandingInvoice
+}
+
+// outstandingInvoices returns the invoices that still have an amount due at
+// asOf. Invoices not yet due count as 0 days past due.
+func outstandingInvoices(statuses []*qbchain.InvoiceStatus, asOf time.Time) []outstanding {
+	day := asOf.Truncate(24 * time.Hour)
+
+	var result []outstanding
+	for _, s := range statuses {
+		if s.State == qbchain.InvoicePaid || s.State == qbchain.InvoiceVoided || s.Total <= s.Paid {
+			continue
+		}
+		inv, err := s.History[0].Invoice()
+		if err != nil {
+			continue
+		}
+
+		days := 0
+		if due, err := time.Parse(qbchain.InvoiceDateLayout, inv.DueDate); err == nil && day.After(due) {
+			days = int(day.Sub(due).Hours() / 24)
+		}
+
+		result = append(result, outstanding{inv.IssuerCompanyID, inv.BuyerCompanyID, OutstandingInvoice{
+			InvoiceID:   s.InvoiceID,
+			Currency:    inv.Currency,
+			DueDate:     inv.DueDate,
+			Total:       s.Total,
+			Paid:        s.Paid,
+			Outstanding: s.Total - s.Paid,
+			DaysPastDue: days,
+			State:       s.State,
+		}})
+	}
+	return result
+}
+
+// Aging returns one row per company, counterparty, side and currency.
+func Aging(statuses []*qbchain.InvoiceStatus, asOf time.Time) []AgingRow {
+	rows := make(map[[4]string]*AgingRow)
+	row := func(company, counterparty, side, currency string) *AgingRow {
+		key := [4]string{company, counterparty, side, currency}
+		if rows[key] == nil {
+			rows[key] = &AgingRow{CompanyID: company, Counterparty: counterparty, Side: side, Currency: currency}
+		}
+		return rows[key]
+	}
+
+	for _, o := range outstandingInvoices(statuses, asOf) {
+		row(o.issuer, o.buyer, Receivable, o.invoice.Currency).add(o.invoice)
+		row(o.buyer, o.issuer, Payable, o.invoice.Currency).add(o.invoice)
+	}
+
+	result := make([]AgingRow, 0, len(rows))
+	for _, r := range rows {
+		result = append(result, *r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.CompanyID != b.CompanyID {
+			return a.CompanyID < b.CompanyID
+		}
+		if a.Side != b.Side {
+			return a.Side > b.Side
+		}
+		if a.Counterparty != b.Counterparty {
+			return a.Counterparty < b.Counterparty
+		}
+		return a.Currency < b.Currency
+	})
+	return result
+}
+
+// Balances returns the outstanding totals per company and currency.
+func Balances(statuses []*qbchain.InvoiceStatus, asOf time.Time) []BalanceRow {
+	rows := make(map[[2]string]*BalanceRow)
+	row := func(company, currency string) *BalanceRow {
+		key := [2]string{company, currency}
+		if rows[key] == nil {
+			rows[key] = &BalanceRow{CompanyID: company, Currency: currency}
+		}
+		return rows[key]
+	}
+
+	for _, o := range outstandingInvoices(statuses, asOf) {
+		r := row(o.issuer, o.invoice.Currency)
+		r.Receivable += o.invoice.Outstanding
+		r.Net += o.invoice.Outstanding
+
+		r = row(o.buyer, o.invoice.Currency)
+		r.Payable += o.invoice.Outstanding
+		r.Net -= o.invoice.Outstanding
+	}
+
+	result := make([]BalanceRow, 0, len(rows))
+	for _, r := range rows {
+		result = append(result, *r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CompanyID != result[j].CompanyID {
+			return result[i].CompanyID < result[j].CompanyID
+		}
+		return result[i].Currency < result[j].Currency
+	})
+	return result
+}
@@ -0,0 +1,81 @@
+package reports
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	".."
+)
+
+func makeStatus(t *testing.T, number, issuer, buyer, currency, due string, unitPrice, paid int64) *qbchain.InvoiceStatus {
+	inv := &qbchain.Invoice{
+		Number:          number,
+		IssuerCompanyID: issuer,
+		BuyerCompanyID:  buyer,
+		Currency:        currency,
+		IssueDate:       "2018-01-01",
+		DueDate:         due,
+		LineItems:       []qbchain.LineItem{{Description: "Services", Quantity: 1, UnitPrice: unitPrice}},
+	}
+	tx, err := qbchain.NewInvoiceTransaction([]byte(issuer), []byte(buyer), inv)
+	require.NoError(t, err)
+	status, err := qbchain.NewInvoiceStatus(tx)
+	require.NoError(t, err)
+	if paid > 0 {
+		payment := qbchain.NewFollowUpTransaction([]byte(buyer), []byte(issuer), qbchain.KindPayment, number, number+"-P", paid, currency, nil)
+		require.NoError(t, status.Apply(payment))
+	}
+	return status
+}
+
+func TestAging(t *testing.T) {
+	require := require.New(t)
+	asOf, _ := time.Parse(qbchain.InvoiceDateLayout, "2018-06-30")
+
+	statuses := []*qbchain.InvoiceStatus{
+		makeStatus(t, "1", "ACME", "GLOBEX", "USD", "2018-07-15", 100, 0),   // not yet due
+		makeStatus(t, "2", "ACME", "GLOBEX", "USD", "2018-05-15", 200, 50),  // 46 days
+		makeStatus(t, "3", "ACME", "GLOBEX", "USD", "2018-01-31", 300, 0),   // 150 days
+		makeStatus(t, "4", "ACME", "GLOBEX", "USD", "2018-01-31", 400, 400), // paid
+		makeStatus(t, "5", "GLOBEX", "ACME", "EUR", "2018-04-15", 500, 0),   // 76 days
+		makeStatus(t, "6", "ACME", "GLOBEX", "USD", "2018-06-30", 600, 0),   // due today
+		makeStatus(t, "7", "ACME", "GLOBEX", "USD", "2018-06-20", 700, 0),   // 10 days
+	}
+
+	rows := Aging(statuses, asOf)
+	require.Len(rows, 4)
+
+	acme := rows[0]
+	require.Equal("ACME", acme.CompanyID)
+	require.Equal(Receivable, acme.Side)
+	require.Equal(int64(700), acme.Current)
+	require.Equal(int64(700), acme.Days1To30)
+	require.Equal(int64(150), acme.Days31To60)
+	require.Equal(int64(300), acme.Over90)
+	require.Equal(int64(1850), acme.Total)
+	require.Len(acme.Invoices, 5)
+
+	require.Equal("ACME", rows[1].CompanyID)
+	require.Equal(Payable, rows[1].Side)
+	require.Equal("EUR", rows[1].Currency)
+	require.Equal(int64(500), rows[1].Days61To90)
+}
+
+func TestBalances(t *testing.T) {
+	require := require.New(t)
+	asOf, _ := time.Parse(qbchain.InvoiceDateLayout, "2018-06-30")
+
+	statuses := []*qbchain.InvoiceStatus{
+		makeStatus(t, "1", "ACME", "GLOBEX", "USD", "2018-07-15", 100, 0),
+		makeStatus(t, "2", "ACME", "GLOBEX", "USD", "2018-05-15", 200, 50),
+		makeStatus(t, "3", "GLOBEX", "ACME", "USD", "2018-04-15", 500, 0),
+	}
+
+	rows := Balances(statuses, asOf)
+	require.Equal([]BalanceRow{
+		{CompanyID: "ACME", Currency: "USD", Receivable: 250, Payable: 500, Net: -250},
+		{CompanyID: "GLOBEX", Currency: "USD", Receivable: 500, Payable: 250, Net: 250},
+	}, rows)
+}
@@ -0,0 +1,69 @@
+package qbchain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	badgerdb "github.com/dgraph-io/badger"
+)
+
+// ErrAlreadyPending is returned by a Mempool that already holds the exact
+// same transaction.
+var ErrAlreadyPending = errors.New("transaction is already pending")
+
+// Submission tells which transaction of a sender uses a TransactionID, and
+// the block, stored under Key, it was forged into.
+type Submission struct {
+	Transaction []byte `json:"transaction"`
+	Block       []byte `json:"block"`
+	Key         string `json:"key"`
+}
+
+// ConflictError is returned for a transaction whose TransactionID is already
+// used by another transaction of the same sender. Block is the block of the
+// other transaction, nil while it is pending.
+type ConflictError struct {
+	TransactionID string
+	Block         []byte
+}
+
+func (e *ConflictError) Error() string {
+	if e.Block == nil {
+		return fmt.Sprintf("transaction ID %s is already used by a pending transaction", e.TransactionID)
+	}
+	return fmt.Sprintf("transaction ID %s is already used by a transaction of block %x", e.TransactionID, e.Block)
+}
+
+// findSubmission returns the block a transaction was forged into, so that a
+// sender can safely retry a submission, or a *ConflictError when its
+// TransactionID is used by another transaction. Both are nil for a new
+// transaction.
+func findSubmission(db *DB, t *Transaction) (*Block, error) {
+	if t.Header.TransactionID == "" {
+		return nil, nil
+	}
+	s, err := db.getSubmission(t.Header.From, t.Header.TransactionID, []byte(DB_SUBMISSIONS_NAMESPACE))
+	if err == badgerdb.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(s.Transaction, t.Hash()) {
+		return nil, &ConflictError{t.Header.TransactionID, s.Block}
+	}
+
+	value, err := db.Get([]byte(DB_NAMESPACE), []byte(s.Key))
+	if err != nil {
+		log.Printf("Submission %s of %s has no block: %v", t.Header.TransactionID, t.Header.From, err)
+		return nil, nil
+	}
+	var block Block
+	if err := json.Unmarshal(value, &block); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
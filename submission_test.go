@@ -0,0 +1,72 @@
+package qbchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindSubmission(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	issuer := GenerateNewKeypair()
+	payer := GenerateNewKeypair()
+	buyer := payer.Public
+	payment := func(amount int64, timestamp uint32) Transaction {
+		tx := NewFollowUpTransaction(buyer, issuer.Public, KindPayment, "INV-0001", "PAY-1", amount, "USD", nil)
+		tx.Header.Timestamp = timestamp
+		tx.Header.Nonce = tx.GenerateNonce(TRANSACTION_POW)
+		tx.Signature = tx.Sign(payer)
+		return tx
+	}
+	invoice := makeTestInvoiceTransaction(t, issuer, buyer)
+
+	// Nothing is recorded before the transaction is forged
+	forged, err := findSubmission(db, &invoice)
+	require.NoError(err)
+	require.Nil(forged)
+
+	block, _, err := forgeBlock(db, []Transaction{invoice}, GenerateNewKeypair())
+	require.NoError(err)
+
+	// A retry finds the block of the original
+	forged, err = findSubmission(db, &invoice)
+	require.NoError(err)
+	require.Equal(block.BlockHash, forged.BlockHash)
+
+	// Another transaction of the sender cannot reuse the ID
+	other := invoice
+	other.Header.Timestamp++
+	other.Header.Nonce = other.GenerateNonce(TRANSACTION_POW)
+	other.Signature = other.Sign(issuer)
+	_, err = findSubmission(db, &other)
+	require.IsType(&ConflictError{}, err)
+	_, _, err = forgeBlock(db, []Transaction{other}, GenerateNewKeypair())
+	require.Error(err)
+
+	// Transactions without an ID are not recorded, and IDs are per sender
+	anonymous := invoice
+	anonymous.Header.TransactionID = ""
+	forged, err = findSubmission(db, &anonymous)
+	require.NoError(err)
+	require.Nil(forged)
+	_, err = findSubmission(db, &Transaction{Header: TransactionHeader{From: buyer, TransactionID: invoice.Header.TransactionID}})
+	require.NoError(err)
+
+	// Transactions with the same ID in a batch conflict
+	_, _, err = forgeBlock(db, []Transaction{payment(100, block.BlockHeader.Timestamp+1), payment(200, block.BlockHeader.Timestamp+2)}, GenerateNewKeypair())
+	require.NoError(err)
+	paid := NewBlockchain(string(buyer), db).LastBlock()
+	require.Len(*paid.TransactionSlice, 1)
+	require.Equal(int64(100), (*paid.TransactionSlice)[0].Header.Amount)
+
+	// A submission that cannot be read is not taken for a new transaction
+	unread := payment(300, paid.BlockHeader.Timestamp+1)
+	unread.Header.TransactionID = "PAY-2"
+	require.NoError(db.Set([]byte(DB_SUBMISSIONS_NAMESPACE), submissionKey(buyer, "PAY-2"), []byte("{")))
+	_, err = findSubmission(db, &unread)
+	require.Error(err)
+}
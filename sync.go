@@ -0,0 +1,263 @@
+package qbchain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A node that was offline catches up by asking each peer for the head of
+// every account chain it holds (MESSAGE_GET_HEADS), then pulling the blocks
+// after its own head for the chains that differ (MESSAGE_GET_BLOCKS). Pulled
+// blocks are verified and stored like replicated blocks.
+
+// ChainHead is the latest block hash and number of blocks of a chain.
+type ChainHead struct {
+	Latest []byte `json:"latest"`
+	Height int    `json:"height"`
+}
+
+type blocksRequest struct {
+	Account string `json:"account"`
+	After   []byte `json:"after"`
+}
+
+func serveHeads(w io.Writer, db *DB) error {
+	infos, err := db.getChainInfos([]byte(DB_NAMESPACE))
+	if err != nil {
+		return writeMessage(w, MESSAGE_NACK, []byte(err.Error()))
+	}
+
+	heads := make(map[string]ChainHead, len(infos))
+	for pk, info := range infos {
+		heads[pk] = ChainHead{info.Latest, info.Height}
+	}
+	payload, err := json.Marshal(heads)
+	if err != nil {
+		return err
+	}
+	return writeMessage(w, MESSAGE_HEADS, payload)
+}
+
+// serveBlocks replies with up to SYNC_BATCH_SIZE blocks that follow the
+// requested block in the account's chain, or the first blocks of the chain
+// if no block is given.
+func serveBlocks(w io.Writer, db *DB, payload []byte) error {
+	var req blocksRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return writeMessage(w, MESSAGE_NACK, []byte(err.Error()))
+	}
+
+	chain := NewBlockchain(req.Account, db).chain
+	start := 0
+	if !isZeroHash(req.After) {
+		start = -1
+		for i := range chain {
+			if bytes.Equal(chain[i].BlockHash, req.After) {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			return writeMessage(w, MESSAGE_NACK, []byte(fmt.Sprintf("block %x is not in the chain of %s", req.After, req.Account)))
+		}
+	}
+
+	end := start + SYNC_BATCH_SIZE
+	if end > len(chain) {
+		end = len(chain)
+	}
+	blocks, err := json.Marshal(chain[start:end])
+	if err != nil {
+		return err
+	}
+	return writeMessage(w, MESSAGE_BLOCKS, blocks)
+}
+
+func requestHeads(peer string) (map[string]ChainHead, error) {
+	msgType, reply, _, err := request(peer, MESSAGE_GET_HEADS, nil)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != MESSAGE_HEADS {
+		return nil, fmt.Errorf("peer %s did not send heads: %s", peer, reply)
+	}
+
+	heads := make(map[string]ChainHead)
+	err = json.Unmarshal(reply, &heads)
+	return heads, err
+}
+
+func requestBlocks(peer, account string, after []byte) (BlockSlice, error) {
+	payload, err := json.Marshal(blocksRequest{account, after})
+	if err != nil {
+		return nil, err
+	}
+	msgType, reply, _, err := request(peer, MESSAGE_GET_BLOCKS, payload)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != MESSAGE_BLOCKS {
+		return nil, fmt.Errorf("peer %s did not send blocks: %s", peer, reply)
+	}
+
+	var blocks BlockSlice
+	err = json.Unmarshal(reply, &blocks)
+	return blocks, err
+}
+
+// requestChain fetches the whole of an account chain from a peer.
+func requestChain(peer, account string) (BlockSlice, error) {
+	var chain BlockSlice
+	var after []byte
+	for {
+		blocks, err := requestBlocks(peer, account, after)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, blocks...)
+		if len(blocks) < SYNC_BATCH_SIZE {
+			return chain, nil
+		}
+		after = blocks[len(blocks)-1].BlockHash
+	}
+}
+
+// PeerSyncStatus is the outcome of the last sync with a peer. Lag is the
+// number of blocks the peer had that this node still lacked afterwards.
+type PeerSyncStatus struct {
+	Peer     string    `json:"peer"`
+	LastSync time.Time `json:"last_sync"`
+	Accounts int       `json:"accounts"`
+	Behind   int       `json:"behind"`
+	Lag      int       `json:"lag"`
+	Pulled   int       `json:"pulled"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type Syncer struct {
+	db     *DB
+	mu     sync.Mutex
+	status map[string]PeerSyncStatus
+}
+
+func NewSyncer(db *DB) *Syncer {
+	return &Syncer{db: db, status: make(map[string]PeerSyncStatus)}
+}
+
+// Run syncs with every peer at start up and then every interval.
+func (s *Syncer) Run(peers func() []string, interval time.Duration) {
+	for {
+		for _, peer := range peers() {
+			if err := s.SyncPeer(peer); err != nil {
+				log.Printf("Failed to sync with %s: %v", peer, err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// SyncPeer pulls the blocks this node is missing from a peer.
+func (s *Syncer) SyncPeer(peer string) error {
+	status := PeerSyncStatus{Peer: peer, LastSync: time.Now()}
+	defer func() {
+		s.mu.Lock()
+		s.status[peer] = status
+		s.mu.Unlock()
+	}()
+
+	heads, err := requestHeads(peer)
+	if err != nil {
+		status.Error = err.Error()
+		return err
+	}
+	local, err := s.db.getChainInfos([]byte(DB_NAMESPACE))
+	if err != nil {
+		status.Error = err.Error()
+		return err
+	}
+	status.Accounts = len(heads)
+
+	accounts := make([]string, 0, len(heads))
+	for pk := range heads {
+		accounts = append(accounts, pk)
+	}
+	sort.Strings(accounts)
+
+	for _, pk := range accounts {
+		if bytes.Equal(heads[pk].Latest, local[pk].Latest) {
+			continue
+		}
+		status.Behind++
+
+		n, err := s.pull(peer, pk, local[pk].Latest, heads[pk].Latest)
+		status.Pulled += n
+		if err != nil {
+			log.Printf("Failed to sync chain of %s from %s: %v", pk, peer, err)
+			status.Error = err.Error()
+		}
+	}
+
+	if local, err = s.db.getChainInfos([]byte(DB_NAMESPACE)); err != nil {
+		status.Error = err.Error()
+		return err
+	}
+	for pk, head := range heads {
+		if lag := head.Height - local[pk].Height; lag > 0 {
+			status.Lag += lag
+		}
+	}
+
+	log.Printf("Synced with %s: pulled %d blocks, %d blocks behind", peer, status.Pulled, status.Lag)
+	return nil
+}
+
+// pull fetches the blocks after the local head of an account chain until the
+// peer's head is reached, storing each one after verifying it. Blocks that
+// conflict with the local chain are quarantined as forks.
+func (s *Syncer) pull(peer, pk string, after, head []byte) (int, error) {
+	pulled := 0
+	restarted := false
+	for !bytes.Equal(after, head) {
+		blocks, err := requestBlocks(peer, pk, after)
+		if err != nil && !restarted && !isZeroHash(after) {
+			// Our head is not in the peer's chain, so the chains have
+			// forked. Walk the peer's chain from the start instead.
+			after, restarted = nil, true
+			continue
+		}
+		if err != nil {
+			return pulled, err
+		}
+		if len(blocks) == 0 {
+			break
+		}
+		for i := range blocks {
+			err := storeReplicatedBlock(s.db, &blocks[i])
+			if _, forked := err.(*ForkError); err != nil && !forked {
+				return pulled, err
+			}
+			after = blocks[i].BlockHash
+			pulled++
+		}
+	}
+	return pulled, nil
+}
+
+// Status returns the result of the last sync with each peer.
+func (s *Syncer) Status() []PeerSyncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]PeerSyncStatus, 0, len(s.status))
+	for _, status := range s.status {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Peer < statuses[j].Peer })
+	return statuses
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
 	"reflect"
 	"time"
@@ -18,11 +19,15 @@ type Transaction struct {
 }
 
 type TransactionHeader struct {
+	Version       uint8
 	From          []byte
 	To            []byte
 	CompanyID     string
 	TransactionID string
+	Kind          TransactionKind
+	Reference     string
 	Amount        int64
+	Currency      string
 	Timestamp     uint32
 	PayloadHash   []byte
 	PayloadLength uint32
@@ -40,7 +45,7 @@ func (slice TransactionSlice) Len() int {
 func NewTransaction(from []byte, to []byte, amount int64, payload []byte) Transaction {
 
 	t := Transaction{
-		Header:  TransactionHeader{From: from, To: to, Amount: amount},
+		Header:  TransactionHeader{Version: TRANSACTION_HEADER_VERSION, From: from, To: to, Amount: amount},
 		Payload: payload}
 
 	payloadByte := []byte(payload)
@@ -51,8 +56,50 @@ func NewTransaction(from []byte, to []byte, amount int64, payload []byte) Transa
 	return t
 }
 
+// NewInvoiceTransaction creates a transaction carrying the canonical encoding
+// of the invoice, with the header amount set to the invoice total.
+func NewInvoiceTransaction(from []byte, to []byte, inv *Invoice) (Transaction, error) {
+
+	if err := inv.Validate(); err != nil {
+		return Transaction{}, err
+	}
+	payload, err := inv.MarshalBinary()
+	if err != nil {
+		return Transaction{}, err
+	}
+	total, _ := inv.Total()
+
+	t := NewTransaction(from, to, total, payload)
+	t.Header.CompanyID = inv.IssuerCompanyID
+	t.Header.Currency = inv.Currency
+	t.Header.TransactionID = inv.Number
+
+	return t, nil
+}
+
+// NewFollowUpTransaction creates a transaction of the given kind that refers
+// to an earlier invoice by its TransactionID.
+func NewFollowUpTransaction(from []byte, to []byte, kind TransactionKind, invoiceID string, transactionID string, amount int64, currency string, payload []byte) Transaction {
+
+	t := NewTransaction(from, to, amount, payload)
+	t.Header.Currency = currency
+	t.Header.Kind = kind
+	t.Header.Reference = invoiceID
+	t.Header.TransactionID = transactionID
+
+	return t
+}
+
+// Hash is the hash signed by the sender. Headers of version 0 predate the
+// canonical encoding and are hashed in the legacy layout so that their
+// signatures still verify.
 func (t *Transaction) Hash() []byte {
-	headerBytes, _ := t.Header.MarshalBinary()
+	var headerBytes []byte
+	if t.Header.Version == 0 {
+		headerBytes = t.Header.legacyBytes()
+	} else {
+		headerBytes, _ = t.Header.MarshalBinary()
+	}
 	return helpers.SHA256(headerBytes)
 }
 
@@ -76,10 +123,9 @@ func (t *Transaction) VerifyTransaction(pow []byte) bool {
 
 func (t *Transaction) MarshalBinary() ([]byte, error) {
 
-	headerBytes, _ := t.Header.MarshalBinary()
-
-	if len(headerBytes) != TRANSACTION_HEADER_SIZE {
-		return nil, errors.New("Transaction Header marshalling error")
+	headerBytes, err := t.Header.MarshalBinary()
+	if err != nil {
+		return nil, err
 	}
 
 	return append(append(headerBytes, helpers.FitBytesInto(t.Signature, NETWORK_KEY_SIZE)...), t.Payload...), nil
@@ -87,58 +133,103 @@ func (t *Transaction) MarshalBinary() ([]byte, error) {
 
 func (t *Transaction) UnmarshalBinary(d []byte) ([]byte, error) {
 
-	buf := bytes.NewBuffer(d)
-
-	if len(d) < TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE {
-		return nil, errors.New("Insuficient bytes for unmarshalling transaction")
-	}
+	buf := bytes.NewReader(d)
 
 	header := &TransactionHeader{}
-	if err := header.UnmarshalBinary(buf.Next(TRANSACTION_HEADER_SIZE)); err != nil {
+	if err := header.decode(buf); err != nil {
 		return nil, err
 	}
+	if buf.Len() < NETWORK_KEY_SIZE+int(header.PayloadLength) {
+		return nil, errors.New("Insuficient bytes for unmarshalling transaction")
+	}
 
 	t.Header = *header
 
-	t.Signature = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
-	t.Payload = buf.Next(int(t.Header.PayloadLength))
+	sig := make([]byte, NETWORK_KEY_SIZE)
+	buf.Read(sig)
+	t.Signature = helpers.StripByte(sig, 0)
+	t.Payload = make([]byte, header.PayloadLength)
+	buf.Read(t.Payload)
 
-	return buf.Next(helpers.MaxInt), nil
+	return d[len(d)-buf.Len():], nil
 
 }
 
+// MarshalBinary returns the canonical encoding of the header: a version byte
+// followed by every field in declaration order, with variable length fields
+// prefixed by their length.
 func (th *TransactionHeader) MarshalBinary() ([]byte, error) {
 
+	w := new(binaryWriter)
+
+	w.uint8(th.Version)
+	w.bytes(th.From)
+	w.bytes(th.To)
+	w.string(th.CompanyID)
+	w.string(th.TransactionID)
+	w.uint8(uint8(th.Kind))
+	w.string(th.Reference)
+	w.int64(th.Amount)
+	w.string(th.Currency)
+	w.uint32(th.Timestamp)
+	w.bytes(th.PayloadHash)
+	w.uint32(th.PayloadLength)
+	w.uint32(th.Nonce)
+
+	return w.Bytes()
+}
+
+func (th *TransactionHeader) UnmarshalBinary(d []byte) error {
+
+	buf := bytes.NewReader(d)
+	if err := th.decode(buf); err != nil {
+		return err
+	}
+	if buf.Len() != 0 {
+		return errors.New("trailing bytes after transaction header")
+	}
+	return nil
+}
+
+func (th *TransactionHeader) decode(buf *bytes.Reader) error {
+
+	r := &binaryReader{r: buf}
+
+	th.Version = r.uint8()
+	if r.Err() == nil && th.Version > TRANSACTION_HEADER_VERSION {
+		return fmt.Errorf("unsupported transaction header version %d", th.Version)
+	}
+	th.From = r.bytes()
+	th.To = r.bytes()
+	th.CompanyID = r.string()
+	th.TransactionID = r.string()
+	th.Kind = TransactionKind(r.uint8())
+	th.Reference = r.string()
+	th.Amount = r.int64()
+	th.Currency = r.string()
+	th.Timestamp = r.uint32()
+	th.PayloadHash = r.bytes()
+	th.PayloadLength = r.uint32()
+	th.Nonce = r.uint32()
+
+	return r.Err()
+}
+
+// legacyBytes is the fixed size layout hashed by version 0 headers. It only
+// commits to the keys, amount, timestamp, payload and nonce.
+func (th *TransactionHeader) legacyBytes() []byte {
+
 	buf := new(bytes.Buffer)
 
 	buf.Write(helpers.FitBytesInto(th.From, NETWORK_KEY_SIZE))
 	buf.Write(helpers.FitBytesInto(th.To, NETWORK_KEY_SIZE))
-	binary.Write(buf, binary.LittleEndian, th.CompanyID)
-	binary.Write(buf, binary.LittleEndian, th.TransactionID)
 	binary.Write(buf, binary.LittleEndian, th.Amount)
 	binary.Write(buf, binary.LittleEndian, th.Timestamp)
 	buf.Write(helpers.FitBytesInto(th.PayloadHash, 32))
 	binary.Write(buf, binary.LittleEndian, th.PayloadLength)
 	binary.Write(buf, binary.LittleEndian, th.Nonce)
 
-	return buf.Bytes(), nil
-
-}
-
-func (th *TransactionHeader) UnmarshalBinary(d []byte) error {
-
-	buf := bytes.NewBuffer(d)
-	th.From = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
-	th.To = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.CompanyID)
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.TransactionID)
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.Amount)
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.Timestamp)
-	th.PayloadHash = buf.Next(32)
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.PayloadLength)
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.Nonce)
-
-	return nil
+	return buf.Bytes()
 }
 
 func (t *Transaction) GenerateNonce(prefix []byte) uint32 {
@@ -158,10 +249,11 @@ func (t *Transaction) GenerateNonce(prefix []byte) uint32 {
 
 func (slice TransactionSlice) AddTransaction(t Transaction) TransactionSlice {
 
-	// Inserted sorted by timestamp
+	// Inserted sorted by timestamp, after the transactions of the same second
 	for i, tr := range slice {
-		if tr.Header.Timestamp >= t.Header.Timestamp {
-			return append(append(slice[:i], t), slice[i:]...)
+		if tr.Header.Timestamp > t.Header.Timestamp {
+			inserted := append(append(TransactionSlice{}, slice[:i]...), t)
+			return append(inserted, slice[i:]...)
 		}
 	}
 
@@ -190,7 +282,7 @@ func (slice *TransactionSlice) UnmarshalBinary(d []byte) error {
 
 	remaining := d
 
-	for len(remaining) > TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE {
+	for len(remaining) > 0 {
 		t := new(Transaction)
 		rem, err := t.UnmarshalBinary(remaining)
 
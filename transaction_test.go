@@ -0,0 +1,154 @@
+package qbchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func goldenTransactionHeader() TransactionHeader {
+	return TransactionHeader{
+		Version:       TRANSACTION_HEADER_VERSION,
+		From:          []byte("from"),
+		To:            []byte("to"),
+		CompanyID:     "ACME",
+		TransactionID: "INV-1",
+		Kind:          KindPayment,
+		Reference:     "INV-0",
+		Amount:        -2,
+		Currency:      "USD",
+		Timestamp:     0x01020304,
+		PayloadHash:   []byte{0xaa, 0xbb},
+		PayloadLength: 7,
+		Nonce:         9,
+	}
+}
+
+func goldenBlockHeader() BlockHeader {
+	return BlockHeader{
+		Version:    1,
+		Origin:     []byte("origin"),
+		PrevBlock:  []byte{0x01, 0x02},
+		MerkleRoot: []byte{0x03},
+		Timestamp:  0x01020304,
+		Nonce:      9,
+	}
+}
+
+// Golden vectors: changing them breaks every existing signature.
+func TestTransactionHeaderGolden(t *testing.T) {
+	require := require.New(t)
+
+	th := goldenTransactionHeader()
+	b, err := th.MarshalBinary()
+	require.NoError(err)
+	require.Equal("01"+
+		"0400"+"66726f6d"+ // from
+		"0200"+"746f"+ // to
+		"0400"+"41434d45"+ // company ID
+		"0500"+"494e562d31"+ // transaction ID
+		"02"+ // kind
+		"0500"+"494e562d30"+ // reference
+		"feffffffffffffff"+ // amount
+		"0300"+"555344"+ // currency
+		"04030201"+ // timestamp
+		"0200"+"aabb"+ // payload hash
+		"07000000"+ // payload length
+		"09000000", // nonce
+		hex.EncodeToString(b))
+
+	tx := Transaction{Header: th}
+	require.Equal("94243734a9b66320fd2840c037e96561e3cd4615a1e98e4b17b52e0db2354cb6", hex.EncodeToString(tx.Hash()))
+
+	tx.Header.Version = 0
+	require.Equal("d632ee7b8975fb445cecff96b6434f6df617d5a7d45e747a3711dda7715c49b0", hex.EncodeToString(tx.Hash()))
+}
+
+func TestBlockHeaderGolden(t *testing.T) {
+	require := require.New(t)
+
+	bh := goldenBlockHeader()
+	b, err := bh.MarshalBinary()
+	require.NoError(err)
+	require.Equal("0106006f726967696e020001020100030403020109000000", hex.EncodeToString(b))
+	require.Equal("cfb009ff0a061dda82fcd955fdd7ade9150f64687744b8895d8b06d63358a1b6", hex.EncodeToString(bh.Hash()))
+}
+
+func TestTransactionHeaderRoundTrip(t *testing.T) {
+	require := require.New(t)
+
+	th := goldenTransactionHeader()
+	b, err := th.MarshalBinary()
+	require.NoError(err)
+
+	var decoded TransactionHeader
+	require.NoError(decoded.UnmarshalBinary(b))
+	require.Equal(th, decoded)
+
+	require.Error(new(TransactionHeader).UnmarshalBinary(b[:len(b)-1]))
+	require.Error(new(TransactionHeader).UnmarshalBinary(append(b, 0)))
+
+	b[0] = TRANSACTION_HEADER_VERSION + 1
+	require.Error(new(TransactionHeader).UnmarshalBinary(b))
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	require := require.New(t)
+
+	kp := GenerateNewKeypair()
+	block := NewBlock([]byte("prev"))
+	for i := 0; i < 3; i++ {
+		tx := NewTransaction(kp.Public, []byte("to"), int64(i), []byte("payload"))
+		tx.Header.Currency = "EUR"
+		tx.Signature = tx.Sign(kp)
+		block.AddTransaction(&tx)
+	}
+	block.Signature = block.Sign(kp)
+
+	b, err := block.MarshalBinary()
+	require.NoError(err)
+
+	var decoded Block
+	require.NoError(decoded.UnmarshalBinary(b))
+	require.Equal(*block.BlockHeader, *decoded.BlockHeader)
+	require.Equal(block.Signature, decoded.Signature)
+	require.Equal(*block.TransactionSlice, *decoded.TransactionSlice)
+	require.Equal(block.Hash(), decoded.Hash())
+}
+
+// Transactions signed before the canonical encoding keep verifying.
+func TestLegacySignatureVerifies(t *testing.T) {
+	require := require.New(t)
+
+	kp := GenerateNewKeypair()
+	tx := NewTransaction(kp.Public, []byte("to"), 10, []byte("payload"))
+	tx.Header.Version = 0
+	tx.Header.Nonce = tx.GenerateNonce(TRANSACTION_POW)
+	tx.Signature = tx.Sign(kp)
+	require.True(tx.VerifyTransaction(TRANSACTION_POW))
+
+	// The legacy layout does not commit to the company ID, the current one does
+	tx.Header.CompanyID = "OTHER"
+	require.True(SignatureVerify(kp.Public, tx.Signature, tx.Hash()))
+	tx.Header.Version = TRANSACTION_HEADER_VERSION
+	require.False(SignatureVerify(kp.Public, tx.Signature, tx.Hash()))
+}
+
+func TestAddTransactionOrder(t *testing.T) {
+	require := require.New(t)
+
+	var slice TransactionSlice
+	for i, timestamp := range []uint32{20, 10, 20, 10} {
+		tx := NewTransaction([]byte("a"), []byte("b"), int64(i), nil)
+		tx.Header.Timestamp = timestamp
+		slice = slice.AddTransaction(tx)
+	}
+
+	// Sorted by timestamp, in the order added within the same second
+	var amounts []int64
+	for _, tx := range slice {
+		amounts = append(amounts, tx.Header.Amount)
+	}
+	require.Equal([]int64{1, 3, 0, 2}, amounts)
+}
@@ -0,0 +1,358 @@
+package qbchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anthdm/hbbft"
+	"github.com/izqui/helpers"
+)
+
+func init() {
+	gob.Register(hbbft.HBMessage{})
+	gob.Register(&hbbft.ACSMessage{})
+}
+
+// envelope is what TCPTransport writes to a connection, as a stream of gob
+// values. Payload is the gob encoding of the message, signed by validator
+// From for validator To, see envelopeHash. Messages that are not signed with
+// the key of From in the validator set are dropped.
+type envelope struct {
+	From      uint64
+	To        uint64
+	Payload   []byte
+	Signature []byte
+}
+
+// message wraps a HoneyBadger message so that gob encodes its type.
+type message struct {
+	Payload interface{}
+}
+
+func envelopeHash(from, to uint64, payload []byte) []byte {
+	b := make([]byte, 16, 16+len(payload))
+	binary.LittleEndian.PutUint64(b, from)
+	binary.LittleEndian.PutUint64(b[8:], to)
+	return helpers.SHA256(append(b, payload...))
+}
+
+// TCPTransport carries HoneyBadger messages between validator processes.
+// Every peer has its own queue, drained by a goroutine that dials the peer
+// and reconnects with backoff when the connection breaks, so a slow or
+// unreachable validator does not hold up messages to the others.
+type TCPTransport struct {
+	id       uint64
+	keypair  *Keypair
+	listener net.Listener
+	consume  chan hbbft.RPC
+
+	mu    sync.Mutex
+	peers map[uint64]*transportPeer
+
+	closed chan struct{}
+}
+
+type transportPeer struct {
+	addr  string
+	key   []byte
+	queue chan envelope
+
+	// closed when the peer is removed, which stops its queue
+	removed chan struct{}
+}
+
+// NewTCPTransport listens for messages from the other validators on addr.
+// The messages it sends are signed with keypair, the key of validator id.
+func NewTCPTransport(id uint64, addr string, keypair *Keypair) (*TCPTransport, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TCPTransport{
+		id:       id,
+		keypair:  keypair,
+		listener: l,
+		consume:  make(chan hbbft.RPC, TRANSPORT_QUEUE_SIZE),
+		peers:    make(map[uint64]*transportPeer),
+		closed:   make(chan struct{}),
+	}
+	go t.accept()
+	return t, nil
+}
+
+// ListenAddr is the address the transport accepts connections on.
+func (t *TCPTransport) ListenAddr() string {
+	return t.listener.Addr().String()
+}
+
+// AddPeer sets the address and public key of another validator and starts
+// its queue. A peer at a new address gets a new queue, the messages queued
+// for the old address are dropped.
+func (t *TCPTransport) AddPeer(id uint64, addr string, key []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if id == t.id {
+		return
+	}
+	if p, ok := t.peers[id]; ok {
+		if p.addr == addr {
+			p.key = key
+			return
+		}
+		t.removePeer(id)
+	}
+	p := &transportPeer{addr: addr, key: key, queue: make(chan envelope, TRANSPORT_QUEUE_SIZE), removed: make(chan struct{})}
+	t.peers[id] = p
+	go t.drain(id, p)
+}
+
+// RemovePeer stops the queue of a validator that left the set. Its messages
+// are no longer accepted.
+func (t *TCPTransport) RemovePeer(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.removePeer(id)
+}
+
+func (t *TCPTransport) removePeer(id uint64) {
+	if p, ok := t.peers[id]; ok {
+		close(p.removed)
+		delete(t.peers, id)
+	}
+}
+
+// Close stops accepting messages and sending queued ones.
+func (t *TCPTransport) Close() error {
+	select {
+	case <-t.closed:
+		return nil
+	default:
+	}
+	close(t.closed)
+	return t.listener.Close()
+}
+
+func (t *TCPTransport) Consume() <-chan hbbft.RPC {
+	return t.consume
+}
+
+// SendProofMessages sends msgs[i] to the i-th peer in order of ID.
+func (t *TCPTransport) SendProofMessages(from uint64, msgs []interface{}) error {
+	ids := t.peerIDs()
+	if len(msgs) != len(ids) {
+		return fmt.Errorf("%d proof messages for %d peers", len(msgs), len(ids))
+	}
+	for i, id := range ids {
+		if err := t.SendMessage(from, id, msgs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TCPTransport) Broadcast(from uint64, msg interface{}) error {
+	for _, id := range t.peerIDs() {
+		if err := t.SendMessage(from, id, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendMessage signs a message and queues it for a peer. It fails if the
+// peer is unknown or its queue is full.
+func (t *TCPTransport) SendMessage(from, to uint64, msg interface{}) error {
+	t.mu.Lock()
+	p, ok := t.peers[to]
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown validator %d", to)
+	}
+
+	e, err := t.seal(from, to, msg)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case p.queue <- e:
+		return nil
+	default:
+		return fmt.Errorf("queue of validator %d is full", to)
+	}
+}
+
+// Connect adds another TCPTransport as a peer; other transports are ignored.
+func (t *TCPTransport) Connect(addr uint64, tr hbbft.Transport) {
+	if other, ok := tr.(*TCPTransport); ok {
+		t.AddPeer(addr, other.ListenAddr(), other.keypair.Public)
+	}
+}
+
+func (t *TCPTransport) Addr() uint64 {
+	return t.id
+}
+
+func (t *TCPTransport) peerIDs() []uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := make([]uint64, 0, len(t.peers))
+	for id := range t.peers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// drain writes the queued messages of a peer, reconnecting as needed. A
+// message that could not be written is sent again on the next connection.
+func (t *TCPTransport) drain(id uint64, p *transportPeer) {
+	var (
+		conn    net.Conn
+		enc     *gob.Encoder
+		pending *envelope
+		delay   = TRANSPORT_MIN_BACKOFF
+	)
+
+	for {
+		if pending == nil {
+			select {
+			case msg := <-p.queue:
+				pending = &msg
+			case <-p.removed:
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			case <-t.closed:
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
+		}
+
+		if conn == nil {
+			c, err := net.DialTimeout("tcp", p.addr, PEER_TIMEOUT)
+			if err != nil {
+				log.Printf("Failed to connect to validator %d at %s, retrying in %s: %v", id, p.addr, delay, err)
+				select {
+				case <-time.After(delay):
+				case <-p.removed:
+					return
+				case <-t.closed:
+					return
+				}
+				if delay *= 2; delay > TRANSPORT_MAX_BACKOFF {
+					delay = TRANSPORT_MAX_BACKOFF
+				}
+				continue
+			}
+			conn, enc, delay = c, gob.NewEncoder(c), TRANSPORT_MIN_BACKOFF
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(PEER_TIMEOUT))
+		if err := enc.Encode(pending); err != nil {
+			log.Printf("Lost connection to validator %d: %v", id, err)
+			conn.Close()
+			conn = nil
+			continue
+		}
+		pending = nil
+	}
+}
+
+func (t *TCPTransport) accept() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.closed:
+			default:
+				log.Println("Error: ", err)
+			}
+			return
+		}
+		go t.receive(conn)
+	}
+}
+
+func (t *TCPTransport) receive(conn net.Conn) {
+	defer conn.Close()
+	dec := gob.NewDecoder(conn)
+
+	for {
+		var msg envelope
+		if err := dec.Decode(&msg); err != nil {
+			if err != io.EOF {
+				log.Printf("Failed to decode message from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		payload, err := t.open(&msg)
+		if err != nil {
+			log.Printf("Dropped message from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		select {
+		case t.consume <- hbbft.RPC{NodeID: msg.From, Payload: payload}:
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+// seal encodes a message and signs it with the key of this validator.
+func (t *TCPTransport) seal(from, to uint64, msg interface{}) (envelope, error) {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(&message{msg}); err != nil {
+		return envelope{}, err
+	}
+	sig, err := t.keypair.Sign(envelopeHash(from, to, payload.Bytes()))
+	if err != nil {
+		return envelope{}, err
+	}
+	return envelope{from, to, payload.Bytes(), sig}, nil
+}
+
+// open checks that an envelope is addressed to this validator and signed by
+// the validator it claims to come from, and decodes its message.
+func (t *TCPTransport) open(msg *envelope) (interface{}, error) {
+	t.mu.Lock()
+	p, ok := t.peers[msg.From]
+	var key []byte
+	if ok {
+		key = p.key
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown validator %d", msg.From)
+	}
+	if msg.To != t.id {
+		return nil, fmt.Errorf("message is addressed to validator %d", msg.To)
+	}
+	if !SignatureVerify(key, msg.Signature, envelopeHash(msg.From, msg.To, msg.Payload)) {
+		return nil, fmt.Errorf("message is not signed by validator %d", msg.From)
+	}
+
+	var m message
+	if err := gob.NewDecoder(bytes.NewReader(msg.Payload)).Decode(&m); err != nil {
+		return nil, err
+	}
+	return m.Payload, nil
+}
@@ -0,0 +1,253 @@
+package qbchain
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anthdm/hbbft"
+	"github.com/stretchr/testify/require"
+)
+
+// freeAddrs returns n localhost addresses that nothing listens on.
+func freeAddrs(t *testing.T, n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addrs[i] = l.Addr().String()
+		l.Close()
+	}
+	return addrs
+}
+
+func TestTCPTransport(t *testing.T) {
+	require := require.New(t)
+	addrs := freeAddrs(t, 2)
+
+	a, err := NewTCPTransport(0, addrs[0], GenerateNewKeypair())
+	require.NoError(err)
+	defer a.Close()
+	bKey := GenerateNewKeypair()
+
+	// Messages wait in the queue until the peer is up
+	a.AddPeer(1, addrs[1], bKey.Public)
+	msg := hbbft.HBMessage{Epoch: 7, Payload: &hbbft.ACSMessage{ProposerID: 0}}
+	require.NoError(a.SendMessage(0, 1, msg))
+	require.Error(a.SendMessage(0, 2, msg))
+	time.Sleep(3 * TRANSPORT_MIN_BACKOFF)
+
+	b, err := NewTCPTransport(1, addrs[1], bKey)
+	require.NoError(err)
+	defer b.Close()
+	b.Connect(0, a)
+
+	select {
+	case rpc := <-b.Consume():
+		require.Equal(uint64(0), rpc.NodeID)
+		require.Equal(uint64(7), rpc.Payload.(hbbft.HBMessage).Epoch)
+	case <-time.After(10 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+
+	require.NoError(b.Broadcast(1, msg))
+	select {
+	case rpc := <-a.Consume():
+		require.Equal(uint64(1), rpc.NodeID)
+	case <-time.After(10 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+
+	// Messages that claim to come from validator 0 without its signature,
+	// or that were sent to another validator, are dropped
+	c, err := NewTCPTransport(2, freeAddrs(t, 1)[0], GenerateNewKeypair())
+	require.NoError(err)
+	defer c.Close()
+	c.AddPeer(0, addrs[0], a.keypair.Public)
+	impostor := &TCPTransport{id: 0, keypair: GenerateNewKeypair()}
+	forged, err := impostor.seal(0, 1, msg)
+	require.NoError(err)
+	_, err = b.open(&forged)
+	require.Error(err)
+
+	genuine, err := a.seal(0, 1, msg)
+	require.NoError(err)
+	payload, err := b.open(&genuine)
+	require.NoError(err)
+	require.Equal(uint64(7), payload.(hbbft.HBMessage).Epoch)
+	_, err = c.open(&genuine)
+	require.Error(err)
+}
+
+// A validator that leaves the set is dropped by the transport, and is
+// reached at its new address when it joins again
+func TestTCPTransportValidatorRejoin(t *testing.T) {
+	require := require.New(t)
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	addrs := freeAddrs(t, 5)
+	set, keys := makeTestValidatorSet(t, addrs[:4])
+	a, err := NewTCPTransport(0, addrs[0], keys[0])
+	require.NoError(err)
+	defer a.Close()
+	c := NewConsensus(0, set, CONSENSUS_BATCH_SIZE, a, db, keys[0])
+	require.Equal([]uint64{1, 2, 3}, a.peerIDs())
+
+	msg := hbbft.HBMessage{Epoch: 7, Payload: &hbbft.ACSMessage{ProposerID: 0}}
+	leaver := &TCPTransport{id: 3, keypair: keys[3]}
+	sealed, err := leaver.seal(3, 0, msg)
+	require.NoError(err)
+	_, err = a.open(&sealed)
+	require.NoError(err)
+
+	c.set, err = NewValidatorSet(set.Validators[:3])
+	require.NoError(err)
+	c.connect()
+	require.Equal([]uint64{1, 2}, a.peerIDs())
+	require.Error(a.SendMessage(0, 3, msg))
+	_, err = a.open(&sealed)
+	require.Error(err)
+
+	moved, err := NewTCPTransport(3, addrs[4], keys[3])
+	require.NoError(err)
+	defer moved.Close()
+	moved.AddPeer(0, addrs[0], keys[0].Public)
+	c.set, err = NewValidatorSet(append(set.Validators[:3:3], Validator{3, string(keys[3].Public), addrs[4]}))
+	require.NoError(err)
+	c.connect()
+	require.Equal([]uint64{1, 2, 3}, a.peerIDs())
+	_, err = a.open(&sealed)
+	require.NoError(err)
+
+	require.NoError(a.SendMessage(0, 3, msg))
+	select {
+	case rpc := <-moved.Consume():
+		require.Equal(uint64(0), rpc.NodeID)
+	case <-time.After(10 * time.Second):
+		t.Fatal("message was not delivered to the new address")
+	}
+}
+
+// TestValidatorProcess runs a single validator when started by
+// TestValidatorProcesses and prints the head of the issuer's chain once the
+// submitted transaction is committed.
+func TestValidatorProcess(t *testing.T) {
+	if os.Getenv("QBCHAIN_VALIDATORS") == "" {
+		t.Skip("only run as a child of TestValidatorProcesses")
+	}
+	require := require.New(t)
+
+	addrs := strings.Split(os.Getenv("QBCHAIN_VALIDATORS"), ",")
+	id, err := strconv.ParseUint(os.Getenv("QBCHAIN_VALIDATOR_ID"), 10, 64)
+	require.NoError(err)
+	txJSON, err := ioutil.ReadFile(os.Getenv("QBCHAIN_TRANSACTION"))
+	require.NoError(err)
+	var tx Transaction
+	require.NoError(json.Unmarshal(txJSON, &tx))
+	keysJSON, err := ioutil.ReadFile(os.Getenv("QBCHAIN_VALIDATOR_KEYS"))
+	require.NoError(err)
+	var keys []*Keypair
+	require.NoError(json.Unmarshal(keysJSON, &keys))
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	transport, err := NewTCPTransport(id, addrs[id], keys[id])
+	require.NoError(err)
+	defer transport.Close()
+	validators := make([]Validator, len(addrs))
+	for i, addr := range addrs {
+		validators[i] = Validator{uint64(i), string(keys[i].Public), addr}
+	}
+	set, err := NewValidatorSet(validators)
+	require.NoError(err)
+
+	c := NewConsensus(id, set, CONSENSUS_BATCH_SIZE, transport, db, keys[id])
+	require.NoError(c.Submit(tx))
+	go c.Run()
+
+	deadline := time.Now().Add(20 * time.Second)
+	bc := NewBlockchain(string(tx.Header.From), db)
+	for len(bc.chain) == 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		bc = NewBlockchain(string(tx.Header.From), db)
+	}
+	require.Len(bc.chain, 1)
+	fmt.Printf("COMMITTED %s\n", hex.EncodeToString(bc.latest))
+
+	// Keep answering the other validators until they are done as well
+	time.Sleep(2 * time.Second)
+}
+
+func TestValidatorProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts four processes")
+	}
+	require := require.New(t)
+
+	const n = 4
+	addrs := freeAddrs(t, n)
+
+	tmpDir, err := ioutil.TempDir("", "qbchain-validators")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	tx := makeTestInvoiceTransaction(t, GenerateNewKeypair(), GenerateNewKeypair().Public)
+	txJSON, err := json.Marshal(tx)
+	require.NoError(err)
+	txFile := path.Join(tmpDir, "transaction.json")
+	require.NoError(ioutil.WriteFile(txFile, txJSON, 0600))
+	_, keys := makeTestValidatorSet(t, addrs)
+	keysJSON, err := json.Marshal(keys)
+	require.NoError(err)
+	keysFile := path.Join(tmpDir, "keys.json")
+	require.NoError(ioutil.WriteFile(keysFile, keysJSON, 0600))
+
+	heads := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestValidatorProcess$", "-test.v")
+		cmd.Env = append(os.Environ(),
+			"QBCHAIN_VALIDATORS="+strings.Join(addrs, ","),
+			"QBCHAIN_VALIDATOR_ID="+strconv.Itoa(i),
+			"QBCHAIN_TRANSACTION="+txFile,
+			"QBCHAIN_VALIDATOR_KEYS="+keysFile,
+		)
+		out, err := cmd.StdoutPipe()
+		require.NoError(err)
+		require.NoError(cmd.Start())
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			scanner := bufio.NewScanner(out)
+			for scanner.Scan() {
+				line := scanner.Text()
+				if j := strings.Index(line, "COMMITTED "); j >= 0 {
+					heads[i] = line[j+len("COMMITTED "):]
+				}
+			}
+			errs[i] = cmd.Wait()
+		}(i)
+	}
+	wg.Wait()
+
+	// Every validator committed the same batch into the same block
+	for i := 0; i < n; i++ {
+		require.NoError(errs[i], "validator %d", i)
+		require.NotEmpty(heads[i], "validator %d", i)
+		require.Equal(heads[0], heads[i], "validator %d", i)
+	}
+}
@@ -0,0 +1,177 @@
+package qbchain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/izqui/helpers"
+)
+
+// Validator is a member company of the consortium that takes part in
+// HoneyBadger BFT.
+type Validator struct {
+	ID        uint64 `json:"id" mapstructure:"id"`
+	PublicKey string `json:"public_key" mapstructure:"public_key"`
+	Address   string `json:"address" mapstructure:"address"`
+}
+
+// ValidatorSet is the set of validators from epoch Epoch on.
+type ValidatorSet struct {
+	Epoch      uint64      `json:"epoch"`
+	Validators []Validator `json:"validators"`
+}
+
+func NewValidatorSet(validators []Validator) (*ValidatorSet, error) {
+	set := &ValidatorSet{Validators: append([]Validator{}, validators...)}
+	sort.Slice(set.Validators, func(i, j int) bool { return set.Validators[i].ID < set.Validators[j].ID })
+	return set, set.Validate()
+}
+
+func (s *ValidatorSet) Validate() error {
+	if len(s.Validators) == 0 {
+		return errors.New("validator set is empty")
+	}
+	for i, v := range s.Validators {
+		if v.PublicKey == "" || v.Address == "" {
+			return fmt.Errorf("validator %d needs a public key and an address", v.ID)
+		}
+		if i > 0 && s.Validators[i-1].ID == v.ID {
+			return fmt.Errorf("validator ID %d is used twice", v.ID)
+		}
+	}
+	return nil
+}
+
+func (s *ValidatorSet) IDs() []uint64 {
+	ids := make([]uint64, len(s.Validators))
+	for i, v := range s.Validators {
+		ids[i] = v.ID
+	}
+	return ids
+}
+
+func (s *ValidatorSet) Get(id uint64) (Validator, bool) {
+	for _, v := range s.Validators {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return Validator{}, false
+}
+
+// Quorum is the number of validators that must sign a proposal: all but the
+// f = (n-1)/3 faulty validators HoneyBadger BFT tolerates.
+func (s *ValidatorSet) Quorum() int {
+	n := len(s.Validators)
+	return n - (n-1)/3
+}
+
+// Kinds of ValidatorProposal
+const (
+	ProposalJoin  = "join"
+	ProposalLeave = "leave"
+)
+
+// ValidatorProposal adds a validator to or removes one from the set from
+// Epoch on. It must be signed by a quorum of the current validators, and a
+// join also by the joining validator.
+type ValidatorProposal struct {
+	Action     string              `json:"action"`
+	Validator  Validator           `json:"validator"`
+	Epoch      uint64              `json:"epoch"`
+	Signatures []ProposalSignature `json:"signatures"`
+}
+
+type ProposalSignature struct {
+	PublicKey string `json:"public_key"`
+	Signature []byte `json:"signature"`
+}
+
+// Hash is what the signatures of a proposal sign.
+func (p *ValidatorProposal) Hash() []byte {
+	w := new(binaryWriter)
+	w.string(p.Action)
+	w.int64(int64(p.Validator.ID))
+	w.string(p.Validator.PublicKey)
+	w.string(p.Validator.Address)
+	w.int64(int64(p.Epoch))
+	b, _ := w.Bytes()
+	return helpers.SHA256(b)
+}
+
+func (p *ValidatorProposal) Sign(keypair *Keypair) error {
+	sig, err := keypair.Sign(p.Hash())
+	if err != nil {
+		return err
+	}
+	p.Signatures = append(p.Signatures, ProposalSignature{string(keypair.Public), sig})
+	return nil
+}
+
+func (p *ValidatorProposal) signedBy(publicKey string) bool {
+	hash := p.Hash()
+	for _, s := range p.Signatures {
+		if s.PublicKey == publicKey && SignatureVerify([]byte(publicKey), s.Signature, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks a proposal against the set it changes and the current epoch.
+func (p *ValidatorProposal) Verify(set *ValidatorSet, epoch uint64) error {
+	if p.Epoch <= epoch {
+		return fmt.Errorf("proposal must take effect after the current epoch %d", epoch)
+	}
+
+	_, member := set.Get(p.Validator.ID)
+	switch p.Action {
+	case ProposalJoin:
+		if member {
+			return fmt.Errorf("validator %d is already in the set", p.Validator.ID)
+		}
+		if p.Validator.PublicKey == "" || p.Validator.Address == "" {
+			return errors.New("joining validator needs a public key and an address")
+		}
+		if !p.signedBy(p.Validator.PublicKey) {
+			return errors.New("proposal is not signed by the joining validator")
+		}
+	case ProposalLeave:
+		if !member {
+			return fmt.Errorf("validator %d is not in the set", p.Validator.ID)
+		}
+		if len(set.Validators) == 1 {
+			return errors.New("the last validator cannot leave")
+		}
+	default:
+		return fmt.Errorf("unknown proposal action %q", p.Action)
+	}
+
+	signed := 0
+	for _, v := range set.Validators {
+		if p.signedBy(v.PublicKey) {
+			signed++
+		}
+	}
+	if signed < set.Quorum() {
+		return fmt.Errorf("proposal is signed by %d validators, %d are needed", signed, set.Quorum())
+	}
+	return nil
+}
+
+// Apply returns the set that results from the proposal.
+func (p *ValidatorProposal) Apply(set *ValidatorSet) *ValidatorSet {
+	next := &ValidatorSet{Epoch: p.Epoch}
+	for _, v := range set.Validators {
+		if p.Action == ProposalLeave && v.ID == p.Validator.ID {
+			continue
+		}
+		next.Validators = append(next.Validators, v)
+	}
+	if p.Action == ProposalJoin {
+		next.Validators = append(next.Validators, p.Validator)
+	}
+	sort.Slice(next.Validators, func(i, j int) bool { return next.Validators[i].ID < next.Validators[j].ID })
+	return next
+}
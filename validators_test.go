@@ -0,0 +1,145 @@
+package qbchain
+
+import (
+	"testing"
+
+	"github.com/anthdm/hbbft"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatorSetQuorum(t *testing.T) {
+	require := require.New(t)
+
+	for n, quorum := range map[int]int{1: 1, 3: 3, 4: 3, 5: 4, 7: 5} {
+		set := &ValidatorSet{Validators: make([]Validator, n)}
+		require.Equal(quorum, set.Quorum(), "%d validators", n)
+	}
+
+	_, err := NewValidatorSet([]Validator{{0, "a", "localhost:9100"}, {0, "b", "localhost:9101"}})
+	require.Error(err)
+}
+
+func TestValidatorProposal(t *testing.T) {
+	require := require.New(t)
+
+	set, keys := makeTestValidatorSet(t, []string{"local0", "local1", "local2", "local3"})
+	joining := GenerateNewKeypair()
+	p := &ValidatorProposal{
+		Action:    ProposalJoin,
+		Validator: Validator{4, string(joining.Public), "local4"},
+		Epoch:     10,
+	}
+
+	// The joining validator and a quorum of the set must sign
+	for _, k := range keys[:3] {
+		require.NoError(p.Sign(k))
+	}
+	require.Error(p.Verify(set, 0))
+	require.NoError(p.Sign(joining))
+	require.NoError(p.Verify(set, 0))
+
+	// It cannot take effect in the past
+	require.Error(p.Verify(set, 10))
+
+	next := p.Apply(set)
+	require.Equal(uint64(10), next.Epoch)
+	require.Equal([]uint64{0, 1, 2, 3, 4}, next.IDs())
+
+	leave := &ValidatorProposal{Action: ProposalLeave, Validator: Validator{ID: 2}, Epoch: 20}
+	for _, k := range keys[:2] {
+		require.NoError(leave.Sign(k))
+	}
+	require.Error(leave.Verify(next, 10))
+	require.NoError(leave.Sign(keys[3]))
+	require.NoError(leave.Sign(joining))
+	require.NoError(leave.Verify(next, 10))
+	require.Equal([]uint64{0, 1, 3, 4}, leave.Apply(next).IDs())
+}
+
+func TestValidatorProposalActivation(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	set, keys := makeTestValidatorSet(t, []string{"local0", "local1", "local2", "local3"})
+	c := NewConsensus(0, set, CONSENSUS_BATCH_SIZE, hbbft.NewLocalTransport(0), db, GenerateNewKeypair())
+
+	leave := &ValidatorProposal{Action: ProposalLeave, Validator: Validator{ID: 3}, Epoch: 2}
+	for _, k := range keys {
+		require.NoError(leave.Sign(k))
+	}
+	require.NoError(c.Propose(leave))
+
+	// The proposal is only stored once it is committed, in epoch 0
+	status, err := c.Status()
+	require.NoError(err)
+	require.Empty(status.Pending)
+	require.Equal(0, c.Commit())
+	status, err = c.Status()
+	require.NoError(err)
+	require.Len(status.Pending, 1)
+	require.Len(status.Set.Validators, 4)
+	require.Equal(uint64(1), status.Epoch)
+
+	// A transaction submitted to the previous set is not lost
+	issuer := GenerateNewKeypair()
+	tx := makeTestInvoiceTransaction(t, issuer, GenerateNewKeypair().Public)
+	require.NoError(c.Submit(tx))
+
+	// Nothing changes before the epoch of the proposal
+	require.False(c.activateProposals())
+
+	c.epoch = 2
+	require.True(c.activateProposals())
+	status, err = c.Status()
+	require.NoError(err)
+	require.Empty(status.Pending)
+	require.Equal(uint64(2), status.Set.Epoch)
+	require.Equal([]uint64{0, 1, 2}, status.Set.IDs())
+	require.True(status.Validating)
+
+	require.Equal(1, c.Commit())
+	require.Len(NewBlockchain(string(issuer.Public), db).chain, 1)
+	require.Empty(c.pending)
+
+	// The new set is used after a restart
+	restarted := NewConsensus(0, set, CONSENSUS_BATCH_SIZE, hbbft.NewLocalTransport(0), db, GenerateNewKeypair())
+	require.Equal([]uint64{0, 1, 2}, restarted.set.IDs())
+	require.Equal(uint64(2), restarted.epoch)
+}
+
+func TestValidatorProposalCommittedEpoch(t *testing.T) {
+	require := require.New(t)
+
+	db, cleanup := makeDBTest(t)
+	defer cleanup()
+
+	set, keys := makeTestValidatorSet(t, []string{"local0", "local1", "local2", "local3"})
+	c := NewConsensus(0, set, CONSENSUS_BATCH_SIZE, hbbft.NewLocalTransport(0), db, GenerateNewKeypair())
+
+	// Committed in epoch 0, the proposal takes effect at the end of it
+	leave := &ValidatorProposal{Action: ProposalLeave, Validator: Validator{ID: 3}, Epoch: 1}
+	for _, k := range keys {
+		require.NoError(leave.Sign(k))
+	}
+	require.NoError(c.Propose(leave))
+	c.Commit()
+	status, err := c.Status()
+	require.NoError(err)
+	require.Equal(uint64(1), status.Set.Epoch)
+	require.Equal([]uint64{0, 1, 2}, status.Set.IDs())
+
+	// Committed at or after its epoch, a proposal is dropped
+	late := &ValidatorProposal{Action: ProposalLeave, Validator: Validator{ID: 2}, Epoch: 2}
+	for _, k := range keys[:3] {
+		require.NoError(late.Sign(k))
+	}
+	require.NoError(c.Propose(late))
+	c.epoch, c.base = 2, 2
+	c.Commit()
+	status, err = c.Status()
+	require.NoError(err)
+	require.Empty(status.Pending)
+	require.Equal([]uint64{0, 1, 2}, status.Set.IDs())
+}